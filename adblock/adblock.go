@@ -1,67 +1,280 @@
 package adblock
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"log"
+	"slices"
 	"strings"
+	"sync"
 
 	"github.com/LucasSnatiago/GoProxy/pac"
-	iradix "github.com/hashicorp/go-immutable-radix/v2"
 )
 
+// Categories lists are usually sorted in, any other name works too
+const (
+	CategoryAds      = "ads"
+	CategoryMalware  = "malware"
+	CategorySocial   = "social"
+	CategoryGambling = "gambling"
+)
+
+// List is one block list. Its rules are kept while it is disabled so it can
+// be turned back on without downloading it again.
+type List struct {
+	Name     string
+	URL      string
+	Category string
+	Enabled  bool
+	Exact    bool   // listed hosts don't block their subdomains, for hosts and plain lists
+	Rules    *Rules // downloaded by NewAdblock when nil
+
+	source listSource // validators of the download Rules came from
+}
+
+// SetEnabled turns blocking on or off, the lists are kept either way
+func (a *AdBlocker) SetEnabled(enabled bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.enabled = enabled
+}
+
+// Enabled reports whether anything is blocked
+func (a *AdBlocker) Enabled() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.enabled
+}
+
+// Len returns how many block rules the list has
+func (l List) Len() int {
+	return l.Rules.Len()
+}
+
 type AdBlocker struct {
-	Entries        *iradix.Tree[bool]
+	enabled        bool // nothing is blocked while false, local lists included
+	lists          []List
+	matcher        *matcher   // rules of the enabled lists
+	allow          *localList // checked first, never blocked
+	block          *localList // checked next, always blocked
+	cacheDir       string     // where downloaded lists are kept, "" disables it
+	pacparser      *pac.Pac   // picks the proxies for downloads that can't go direct
+	stopRefresh    context.CancelFunc
 	cachedToString string
+	mu             sync.RWMutex // Protects the fields swapped by update
+	updateMu       sync.Mutex   // Serializes updates, which merge the lists outside mu
 }
 
-func NewAdblock(adblockUrl string, pacparser *pac.Pac) *AdBlocker {
-	adblock := DownloadStevensBlackBlackList(adblockUrl, pacparser)
-	if adblock.Entries.Len() == 0 {
+// NewAdblock downloads every list without rules, disabled ones too. Each
+// download is kept in cacheDir and used when the list can't be downloaded.
+func NewAdblock(lists []List, cacheDir string, pacparser *pac.Pac) *AdBlocker {
+	for i := range lists {
+		if lists[i].Rules != nil {
+			continue
+		}
+		lists[i] = loadList(lists[i], cacheDir, pacparser)
+	}
+	adblock := newAdblock(lists)
+	adblock.cacheDir, adblock.pacparser = cacheDir, pacparser
+	if adblock.Len() == 0 {
 		log.Println("AdBlock is disabled, no entries found.")
 	}
 
 	return adblock
 }
 
-func ParseHostList(scanner *bufio.Scanner) (*iradix.Tree[bool], error) {
-	r := iradix.New[bool]()
-	txn := r.Txn()
+// NewDisabledAdblock returns an empty list that blocks nothing until it is
+// turned on with SetEnabled
+func NewDisabledAdblock() *AdBlocker {
+	adblock := newAdblock(nil)
+	adblock.enabled = false
+	return adblock
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "#") || len(strings.TrimSpace(line)) == 0 {
-			continue
-		}
-		// format: 0.0.0.0 some.domain.com
-		fields := strings.Fields(line)
-		if len(fields) < 2 {
-			continue
+func newAdblock(lists []List) *AdBlocker {
+	return &AdBlocker{
+		enabled: true,
+		lists:   lists,
+		matcher: newMatcher(lists),
+		allow:   newLocalList("", nil),
+		block:   newLocalList("", nil),
+	}
+}
+
+func (a *AdBlocker) CheckIfAppearsOnAdblockList(host string) bool {
+	_, blocked := a.BlockedBy(host)
+	return blocked
+}
+
+// BlockedBy returns the name of the list blocking host. The local allowlist
+// and blocklist win over the downloaded lists.
+func (a *AdBlocker) BlockedBy(host string) (string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !a.enabled {
+		return "", false
+	}
+	key := hostKey(host)
+	if a.allow.rules.blocks(key, host) {
+		return "", false
+	}
+	if a.block.rules.blocks(key, host) {
+		return string(Blocklist), true
+	}
+	return a.matcher.match(host)
+}
+
+// Len returns how many block rules the enabled lists have, 0 means adblock is
+// off
+func (a *AdBlocker) Len() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.matcher.len()
+}
+
+// Loaded returns how many lists have rules, enabled or not. A list that could
+// neither be downloaded nor read from the cache has none.
+func (a *AdBlocker) Loaded() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	loaded := 0
+	for _, list := range a.lists {
+		if list.Rules != nil {
+			loaded++
 		}
-		txn.Insert([]byte(fields[1]), true)
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	return loaded
+}
+
+// Lists returns the configured lists, enabled or not
+func (a *AdBlocker) Lists() []List {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return slices.Clone(a.lists)
+}
+
+// SetCategoryEnabled turns every list of category on or off and returns how
+// many lists it changed. It lasts until the next reload.
+func (a *AdBlocker) SetCategoryEnabled(category string, enabled bool) (int, error) {
+	changed, found := 0, false
+	a.update(func(lists []List) {
+		for i := range lists {
+			if lists[i].Category != category {
+				continue
+			}
+			found = true
+			if lists[i].Enabled != enabled {
+				lists[i].Enabled = enabled
+				changed++
+			}
+		}
+	})
+	if !found {
+		return 0, fmt.Errorf("no adblock list in category %q", category)
 	}
+	return changed, nil
+}
+
+// Replace swaps in the lists of a freshly built AdBlocker, the local lists
+// and whether blocking is enabled are kept
+func (a *AdBlocker) Replace(other *AdBlocker) {
+	other.mu.RLock()
+	lists, m := other.lists, other.matcher
+	cacheDir, pacparser := other.cacheDir, other.pacparser
+	other.mu.RUnlock()
 
-	r = txn.Commit()
-	return r, nil
+	a.updateMu.Lock()
+	defer a.updateMu.Unlock()
+	a.swap(lists, m)
+	a.mu.Lock()
+	a.cacheDir, a.pacparser = cacheDir, pacparser
+	a.mu.Unlock()
 }
 
-func (a *AdBlocker) CheckIfAppearsOnAdblockList(host string) bool {
-	_, found := a.Entries.Get([]byte(host))
-	return found
+// update applies change to a copy of the lists and swaps in the result with
+// its merged rules, lookups keep using the old rules while they are merged
+func (a *AdBlocker) update(change func(lists []List)) {
+	a.updateMu.Lock()
+	defer a.updateMu.Unlock()
+	lists := a.Lists()
+	change(lists)
+	a.swap(lists, newMatcher(lists))
+}
+
+func (a *AdBlocker) swap(lists []List, m *matcher) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lists, a.matcher = lists, m
+	a.cachedToString = ""
+}
+
+// hostKey reverses the labels of host so parent domains are prefixes of
+// their subdomains: stats.g.doubleclick.net becomes net.doubleclick.g.stats.
+// The trailing dot keeps matches on label boundaries.
+func hostKey(host string) []byte {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(host, ".")), ".")
+	slices.Reverse(labels)
+	return []byte(strings.Join(labels, ".") + ".")
+}
+
+// hostFromKey turns a key made by hostKey back into a host name
+func hostFromKey(key []byte) string {
+	labels := strings.Split(strings.TrimSuffix(string(key), "."), ".")
+	slices.Reverse(labels)
+	return strings.Join(labels, ".")
 }
 
 func (a *AdBlocker) ToString() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	if a.cachedToString != "" {
 		return a.cachedToString
 	}
 
 	str := strings.Builder{}
-	str.WriteString(fmt.Sprintf("%d entries:\n", a.Entries.Len()))
-	for host, _ := range a.Entries.Root().Walk {
-		str.WriteString(fmt.Sprintf("%s\n", host))
+	str.WriteString("Lists:\n")
+	for _, list := range a.lists {
+		state := "enabled"
+		if !list.Enabled {
+			state = "disabled"
+		}
+		str.WriteString(fmt.Sprintf("%s (%s, %s): %d entries from %s\n", list.Name, list.Category, state, list.Len(), list.URL))
+	}
+
+	m := a.matcher
+	str.WriteString(fmt.Sprintf("\n%d entries:\n", m.len()))
+	m.entries.Root().Walk(func(key []byte, rule listRule) bool {
+		if rule.subdomains {
+			str.WriteString(fmt.Sprintf("%s (and subdomains) [%s]\n", hostFromKey(key), rule.list))
+		} else {
+			str.WriteString(fmt.Sprintf("%s [%s]\n", hostFromKey(key), rule.list))
+		}
+		return false
+	})
+	for _, p := range m.wildcards {
+		str.WriteString(fmt.Sprintf("%s (pattern) [%s]\n", p.re, p.list))
+	}
+	if m.exceptions.Len()+len(m.exceptionWildcards) > 0 {
+		str.WriteString("\nExceptions:\n")
+		m.exceptions.Root().Walk(func(key []byte, rule listRule) bool {
+			str.WriteString(fmt.Sprintf("%s (and subdomains) [%s]\n", hostFromKey(key), rule.list))
+			return false
+		})
+		for _, p := range m.exceptionWildcards {
+			str.WriteString(fmt.Sprintf("%s (pattern) [%s]\n", p.re, p.list))
+		}
+	}
+	for _, local := range []struct {
+		name LocalList
+		list *localList
+	}{{Allowlist, a.allow}, {Blocklist, a.block}} {
+		if len(local.list.patterns) == 0 {
+			continue
+		}
+		str.WriteString(fmt.Sprintf("\nLocal %s:\n", local.name))
+		for _, pattern := range local.list.patterns {
+			str.WriteString(pattern + "\n")
+		}
 	}
 	a.cachedToString = str.String()
 
@@ -1,23 +1,195 @@
 package adblock
 
 import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 )
 
-const STEVENBLACK_BLACKLIST = "https://raw.githubusercontent.com/StevenBlack/hosts/master/alternates/fakenews-gambling-porn/hosts"
-
 func TestNewAdblock(t *testing.T) {
-	adblocker := NewAdblock(STEVENBLACK_BLACKLIST, nil)
+	fixture, err := os.ReadFile("testdata/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Serves the fixture with an ETag, like raw.githubusercontent.com
+	var mu sync.Mutex
+	body, notModified := fixture, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
 
-	if adblocker == nil {
-		t.Error("Expected NewAdblock to return a valid object")
+	cacheDir := t.TempDir()
+	lists := func() []List {
+		return []List{{Name: "stevenblack", URL: server.URL + "/hosts", Category: CategoryAds, Enabled: true}}
 	}
+	adblocker := NewAdblock(lists(), cacheDir, nil)
 
 	if !adblocker.CheckIfAppearsOnAdblockList("ad-assets.futurecdn.net") {
 		t.Errorf("Expected to find this entry")
 	}
-
 	if adblocker.CheckIfAppearsOnAdblockList("google.com") {
 		t.Errorf("Expected to not find this entry")
 	}
+	// The hosts file boilerplate names the local machine, it blocks nothing
+	for _, host := range []string{"localhost", "x.localhost", "printer.local", "ip6-localhost", "0.0.0.0", "broadcasthost"} {
+		if adblocker.CheckIfAppearsOnAdblockList(host) {
+			t.Errorf("Expected %s not to be blocked", host)
+		}
+	}
+
+	// Unchanged lists are revalidated, not downloaded again
+	changed := adblocker.Refresh()
+	mu.Lock()
+	if changed != 0 || notModified != 1 {
+		t.Errorf("Expected a 304 and no change, got %d changes and %d 304s", changed, notModified)
+	}
+	body = append(slices.Clone(fixture), "0.0.0.0 tracker.example.com\n"...)
+	mu.Unlock()
+
+	if changed := adblocker.Refresh(); changed != 1 {
+		t.Errorf("Expected the list to be refreshed, got %d changes", changed)
+	}
+	if !adblocker.CheckIfAppearsOnAdblockList("tracker.example.com") {
+		t.Errorf("Expected the refreshed list to be swapped in")
+	}
+
+	// Offline, the last download is used
+	server.Close()
+	offline := NewAdblock(lists(), cacheDir, nil)
+	if !offline.CheckIfAppearsOnAdblockList("tracker.example.com") {
+		t.Errorf("Expected the cached copy to be loaded when the list can't be downloaded")
+	}
+	if changed := offline.Refresh(); changed != 0 || !offline.CheckIfAppearsOnAdblockList("ad-assets.futurecdn.net") {
+		t.Errorf("Expected a failed refresh to keep the current rules")
+	}
+}
+
+func TestSubdomainMatching(t *testing.T) {
+	list := "# comment\n0.0.0.0 doubleclick.net\n0.0.0.0 ads.example.com\n"
+	for _, exact := range []bool{false, true} {
+		adblocker := newTestAdblock(t, List{Name: "test", Enabled: true}, list, exact)
+
+		tests := map[string]bool{
+			"doubleclick.net":          true,
+			"DoubleClick.net.":         true,
+			"stats.g.doubleclick.net":  !exact,
+			"notdoubleclick.net":       false,
+			"doubleclick.net.evil.com": false,
+			"ads.example.com":          true,
+			"example.com":              false,
+			"cdn.ads.example.com":      !exact,
+		}
+		for host, want := range tests {
+			if got := adblocker.CheckIfAppearsOnAdblockList(host); got != want {
+				t.Errorf("exact=%v: expected %v for %s, got %v", exact, want, host, got)
+			}
+		}
+	}
+}
+
+func TestCategories(t *testing.T) {
+	adblocker := newAdblock([]List{
+		parsedList(t, List{Name: "ads", Category: CategoryAds, Enabled: true}, "ads.example.com\nshared.example.com\n", false),
+		parsedList(t, List{Name: "social", Category: CategorySocial, Enabled: false}, "social.example.com\nshared.example.com\n", false),
+	})
+
+	if list, ok := adblocker.BlockedBy("shared.example.com"); !ok || list != "ads" {
+		t.Errorf("Expected the ads list to block shared.example.com, got %q %v", list, ok)
+	}
+	if adblocker.CheckIfAppearsOnAdblockList("social.example.com") {
+		t.Error("Expected the disabled social list not to block")
+	}
+
+	if changed, err := adblocker.SetCategoryEnabled(CategorySocial, true); err != nil || changed != 1 {
+		t.Fatalf("Expected one list to be enabled, got %d %v", changed, err)
+	}
+	if list, ok := adblocker.BlockedBy("social.example.com"); !ok || list != "social" {
+		t.Errorf("Expected the social list to block social.example.com, got %q %v", list, ok)
+	}
+	if adblocker.Len() != 3 {
+		t.Errorf("Expected 3 merged entries, got %d", adblocker.Len())
+	}
+	if str := adblocker.ToString(); !strings.Contains(str, "social (social, enabled): 2 entries") ||
+		!strings.Contains(str, "shared.example.com (and subdomains) [ads]") {
+		t.Errorf("Unexpected listing:\n%s", str)
+	}
+
+	if _, err := adblocker.SetCategoryEnabled(CategoryAds, false); err != nil {
+		t.Fatal(err)
+	}
+	if list, ok := adblocker.BlockedBy("shared.example.com"); !ok || list != "social" {
+		t.Errorf("Expected the social list to block shared.example.com, got %q %v", list, ok)
+	}
+	if adblocker.CheckIfAppearsOnAdblockList("ads.example.com") {
+		t.Error("Expected the disabled ads list not to block")
+	}
+
+	if _, err := adblocker.SetCategoryEnabled(CategoryMalware, true); err == nil {
+		t.Error("Expected an error for a category without lists")
+	}
+}
+
+func TestExceptionsStayInTheirList(t *testing.T) {
+	adblocker := newAdblock([]List{
+		parsedList(t, List{Name: "ads", Category: CategoryAds, Enabled: true},
+			"||example.com^\n||static.example.net^\n@@||cdn.example.com^\n@@||*.static.example.net^\n", false),
+		parsedList(t, List{Name: "malware", Category: CategoryMalware, Enabled: true},
+			"||cdn.example.com^\n||evil.static.example.net^\n", false),
+	})
+
+	tests := map[string]string{
+		"example.com":             "ads",
+		"cdn.example.com":         "malware", // the ads exception doesn't cover the malware list
+		"img.cdn.example.com":     "malware",
+		"evil.static.example.net": "malware",
+		"good.static.example.net": "",
+	}
+	for host, want := range tests {
+		if list, ok := adblocker.BlockedBy(host); list != want || ok != (want != "") {
+			t.Errorf("%s: expected %q, got %q %v", host, want, list, ok)
+		}
+	}
+
+	if _, err := adblocker.SetCategoryEnabled(CategoryMalware, false); err != nil {
+		t.Fatal(err)
+	}
+	if adblocker.CheckIfAppearsOnAdblockList("cdn.example.com") {
+		t.Error("Expected the ads exception to unblock its own rule")
+	}
+	if adblocker.Loaded() != 2 || adblocker.Len() != 2 {
+		t.Errorf("Expected 2 loaded lists and 2 enabled entries, got %d and %d", adblocker.Loaded(), adblocker.Len())
+	}
+}
+
+// parsedList returns list with the rules parsed from content
+func parsedList(t *testing.T, list List, content string, exact bool) List {
+	t.Helper()
+	rules, _, err := ParseList([]byte(content), exact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list.Rules = rules
+	return list
+}
+
+func newTestAdblock(t *testing.T, list List, content string, exact bool) *AdBlocker {
+	t.Helper()
+	return newAdblock([]List{parsedList(t, list, content, exact)})
 }
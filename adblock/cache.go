@@ -0,0 +1,56 @@
+package adblock
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/LucasSnatiago/GoProxy/internal/cachefile"
+)
+
+// cachePath is where the last download of listURL is kept, its validators
+// are saved next to it with a .json extension
+func cachePath(cacheDir, listURL string) string {
+	return cachefile.Path(cacheDir, "adblock-", listURL, ".txt")
+}
+
+// saveCachedList keeps data and the validators it was downloaded with
+func saveCachedList(cacheDir string, source listSource, data []byte) error {
+	if cacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create adblock cache directory: %w", err)
+	}
+
+	meta, err := json.Marshal(source)
+	if err != nil {
+		return fmt.Errorf("failed to save adblock list copy: %w", err)
+	}
+	path := cachePath(cacheDir, source.URL)
+	// The list goes first, stale validators only cost a full download
+	if err := cachefile.WriteAtomic(path, data); err != nil {
+		return err
+	}
+	return cachefile.WriteAtomic(path+".json", meta)
+}
+
+func loadCachedList(cacheDir, listURL string) ([]byte, listSource, error) {
+	source := listSource{URL: listURL}
+	if cacheDir == "" {
+		return nil, source, os.ErrNotExist
+	}
+	path := cachePath(cacheDir, listURL)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, source, err
+	}
+	// Without validators the list is still usable, it's just downloaded again
+	if meta, err := os.ReadFile(path + ".json"); err == nil {
+		var saved listSource
+		if json.Unmarshal(meta, &saved) == nil && saved.URL == listURL {
+			source = saved
+		}
+	}
+	return data, source, nil
+}
@@ -1,64 +1,152 @@
 package adblock
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
-	"strings"
 	"time"
 
 	"github.com/LucasSnatiago/GoProxy/pac"
 )
 
-func DownloadStevensBlackBlackList(adblockUrl string, pacparser *pac.Pac) *AdBlocker {
-	data, err := GetBytesFromURL(adblockUrl, pacparser)
-	if err != nil || len(data) == 0 {
-		log.Printf("Failed to download Stevens Black List: %v\nTurning adblock off", err)
+var listClient = &http.Client{
+	Timeout: time.Second * 300,
+}
+
+// listSource is where a list was downloaded from and the validators the
+// server sent with it, so refreshes can ask whether it changed
+type listSource struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// loadList fills in the rules of list from its URL, revalidating the copy in
+// cacheDir. The cached copy is used when the URL can't be reached or what it
+// sends can't be used.
+func loadList(list List, cacheDir string, pacparser *pac.Pac) List {
+	cached, cachedSource, cacheErr := loadCachedList(cacheDir, list.URL)
+	source := listSource{URL: list.URL}
+	if cacheErr == nil {
+		source = cachedSource
 	}
 
-	entries, err := ParseHostList(bufio.NewScanner(strings.NewReader(string(data))))
-	if err != nil || entries.Len() == 0 {
-		log.Printf("Failed to parse Stevens Black List: %v\nTurning adblock off", err)
+	data, fetched, err := fetchList(source, pacparser)
+	switch {
+	case err != nil:
+		log.Printf("Failed to download block list %s: %v", list.URL, err)
+	case data == nil:
+		// Not modified, the cached copy is current
+	default:
+		if rules := parseListData(list.URL, data, list.Exact); rules != nil {
+			list.Rules, list.source = rules, fetched
+			if err := saveCachedList(cacheDir, fetched, data); err != nil {
+				log.Println(err)
+			}
+			return list
+		}
 	}
 
-	return &AdBlocker{
-		Entries: entries,
+	if cacheErr != nil {
+		return list
 	}
+	if data != nil || err != nil {
+		log.Printf("Using the cached copy of %s", list.URL)
+	}
+	if list.Rules = parseListData(list.URL, cached, list.Exact); list.Rules != nil {
+		list.source = cachedSource
+	}
+	return list
+}
+
+func parseListData(listURL string, data []byte, exact bool) *Rules {
+	rules, format, err := ParseList(data, exact)
+	if err != nil || rules.Len() == 0 {
+		log.Printf("Failed to parse block list %s: %v", listURL, err)
+		return nil
+	}
+	log.Printf("Loaded %d rules from %s (%s format)", rules.Len(), listURL, format)
+	return rules
 }
 
 func GetBytesFromURL(link string, p *pac.Pac) ([]byte, error) {
+	data, _, err := fetchList(listSource{URL: link}, p)
+	return data, err
+}
+
+// fetchList downloads the list at source.URL, sending the validators stored
+// in source if any. data is nil when the server answered 304 Not Modified.
+func fetchList(source listSource, p *pac.Pac) ([]byte, listSource, error) {
 	// Trying directly first
-	getReq, err := http.Get(link)
-	if err == nil {
-		defer getReq.Body.Close()
-		return io.ReadAll(getReq.Body)
+	data, fetched, err := fetchListWith(listClient, source)
+	if err == nil || p == nil {
+		return data, fetched, err
 	}
 
 	// Retrying through proxy if direct request fails
 	log.Printf("Failed to get adblock directly. Trying through proxy")
 
-	rawProxyURL := pac.GetFromCache(link, p)
-	proxyUrl := strings.Split(rawProxyURL, " ")
-	proxyTarget, err := url.Parse(fmt.Sprintf("http://%s", proxyUrl[1]))
-	if err != nil {
-		log.Printf("Failed to parse proxy URL %s: %v", rawProxyURL, err)
-		return nil, err
+	candidates, pacErr := pac.HandleProxy(source.URL, p)
+	if pacErr != nil {
+		log.Printf("Failed to resolve proxy for %s: %v", source.URL, pacErr)
+		return nil, source, pacErr
 	}
 
-	client := &http.Client{
-		Transport: &http.Transport{Proxy: http.ProxyURL(proxyTarget)},
-		Timeout:   300 * time.Second,
+	for _, proxyTarget := range candidates {
+		if proxyTarget == nil {
+			continue // direct was already tried
+		}
+
+		client := &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(proxyTarget)},
+			Timeout:   300 * time.Second,
+		}
+
+		data, fetched, err = fetchListWith(client, source)
+		if err != nil {
+			log.Printf("Failed to download %s via %s: %v", source.URL, pac.ProxyName(proxyTarget), err)
+			continue
+		}
+		return data, fetched, nil
+	}
+
+	return nil, source, fmt.Errorf("failed to download %s: %w", source.URL, err)
+}
+
+func fetchListWith(client *http.Client, source listSource) ([]byte, listSource, error) {
+	req, err := http.NewRequest(http.MethodGet, source.URL, nil)
+	if err != nil {
+		return nil, source, err
+	}
+	if source.ETag != "" {
+		req.Header.Set("If-None-Match", source.ETag)
+	}
+	if source.LastModified != "" {
+		req.Header.Set("If-Modified-Since", source.LastModified)
 	}
 
-	resp, err := client.Get(link)
+	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Failed to download %s: %v", link, err)
-		return nil, err
+		return nil, source, err
 	}
 	defer resp.Body.Close()
 
-	return io.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, source, nil
+	default:
+		return nil, source, fmt.Errorf("%s answered %s", source.URL, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, source, fmt.Errorf("failed to read %s: %w", source.URL, err)
+	}
+	return data, listSource{
+		URL:          source.URL,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
 }
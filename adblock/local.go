@@ -0,0 +1,224 @@
+package adblock
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/LucasSnatiago/GoProxy/internal/cachefile"
+	iradix "github.com/hashicorp/go-immutable-radix/v2"
+)
+
+// LocalList is one of the lists kept on this machine, checked before the
+// downloaded lists
+type LocalList string
+
+const (
+	Allowlist LocalList = "allowlist" // never blocked
+	Blocklist LocalList = "blocklist" // always blocked
+)
+
+// localList holds the patterns of a LocalList: domains, which block their
+// subdomains too, and hosts with * wildcards
+type localList struct {
+	path     string // file the patterns are saved in, "" keeps them in memory
+	patterns []string
+	rules    *Rules
+}
+
+func newLocalList(path string, patterns []string) *localList {
+	entries := iradix.New[bool]().Txn()
+	rules := &Rules{Exceptions: iradix.New[bool]()}
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "*") {
+			rules.wildcards = append(rules.wildcards, listPattern{re: wildcardRegexp(pattern)})
+		} else {
+			entries.Insert(hostKey(pattern), true)
+		}
+	}
+	rules.Entries = entries.Commit()
+	return &localList{path: path, patterns: patterns, rules: rules}
+}
+
+// readLocalList reads the patterns in path, one per line. A missing file is
+// an empty list, it is created by the first change.
+func readLocalList(path string) (*localList, error) {
+	if path == "" {
+		return newLocalList("", nil), nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return newLocalList(path, nil), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var patterns []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := stripComment(scanner.Text())
+		if text == "" {
+			continue
+		}
+		pattern, err := normalizePattern(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if !slices.Contains(patterns, pattern) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return newLocalList(path, patterns), nil
+}
+
+func normalizePattern(pattern string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(pattern), "."))
+	if !validDomain(normalized, true) {
+		return "", fmt.Errorf("invalid pattern %q, expected a domain like example.com or *.example.com", pattern)
+	}
+	// * or *.com would cover every host, or a whole top level domain
+	if strings.Contains(normalized, "*") && !strings.Contains(strings.TrimLeft(normalized, "*."), ".") {
+		return "", fmt.Errorf("pattern %q is too broad, wildcards need a domain like *.example.com", pattern)
+	}
+	return normalized, nil
+}
+
+// rewriteLocalFile replaces the lines of path with edit(lines), keeping the
+// comments edit leaves in place
+func rewriteLocalFile(path string, edit func(lines []string) []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	lines = edit(lines)
+	return cachefile.WriteAtomic(path, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// LoadLocalLists reads the allowlist and blocklist files, "" keeps that list
+// in memory only
+func (a *AdBlocker) LoadLocalLists(allowPath, blockPath string) error {
+	allow, err := readLocalList(allowPath)
+	if err != nil {
+		return err
+	}
+	block, err := readLocalList(blockPath)
+	if err != nil {
+		return err
+	}
+
+	a.updateMu.Lock()
+	defer a.updateMu.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.allow, a.block = allow, block
+	a.cachedToString = ""
+	return nil
+}
+
+// AddLocal adds pattern to list and saves it to the list file, if any
+func (a *AdBlocker) AddLocal(list LocalList, pattern string) error {
+	pattern, err := normalizePattern(pattern)
+	if err != nil {
+		return err
+	}
+	return a.editLocal(list, func(current *localList) (*localList, error) {
+		if slices.Contains(current.patterns, pattern) {
+			return current, nil
+		}
+		if current.path != "" {
+			err := rewriteLocalFile(current.path, func(lines []string) []string {
+				return append(lines, pattern)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return newLocalList(current.path, append(slices.Clone(current.patterns), pattern)), nil
+	})
+}
+
+// RemoveLocal removes pattern from list and from the list file, if any
+func (a *AdBlocker) RemoveLocal(list LocalList, pattern string) error {
+	pattern, err := normalizePattern(pattern)
+	if err != nil {
+		return err
+	}
+	return a.editLocal(list, func(current *localList) (*localList, error) {
+		if !slices.Contains(current.patterns, pattern) {
+			return nil, fmt.Errorf("%s is not in the %s", pattern, list)
+		}
+		if current.path != "" {
+			err := rewriteLocalFile(current.path, func(lines []string) []string {
+				return slices.DeleteFunc(lines, func(line string) bool {
+					text, err := normalizePattern(stripComment(line))
+					return err == nil && text == pattern
+				})
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		patterns := slices.DeleteFunc(slices.Clone(current.patterns), func(p string) bool { return p == pattern })
+		return newLocalList(current.path, patterns), nil
+	})
+}
+
+// LocalPatterns returns the patterns in list
+func (a *AdBlocker) LocalPatterns(list LocalList) ([]string, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	local, err := a.local(list)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone((*local).patterns), nil
+}
+
+func (a *AdBlocker) editLocal(list LocalList, edit func(current *localList) (*localList, error)) error {
+	a.updateMu.Lock()
+	defer a.updateMu.Unlock()
+
+	a.mu.RLock()
+	local, err := a.local(list)
+	var current *localList
+	if err == nil {
+		current = *local
+	}
+	a.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	updated, err := edit(current)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	*local = updated
+	a.cachedToString = ""
+	return nil
+}
+
+// local returns the field holding list, mu must be held
+func (a *AdBlocker) local(list LocalList) (**localList, error) {
+	switch list {
+	case Allowlist:
+		return &a.allow, nil
+	case Blocklist:
+		return &a.block, nil
+	}
+	return nil, fmt.Errorf("unknown local list %q", list)
+}
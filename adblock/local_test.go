@@ -0,0 +1,79 @@
+package adblock
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLocalLists(t *testing.T) {
+	dir := t.TempDir()
+	allowPath := filepath.Join(dir, "allowlist.txt")
+	blockPath := filepath.Join(dir, "blocklist.txt")
+	if err := os.WriteFile(allowPath, []byte("# false positives\ndashboard.example.com # ours\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	adblocker := newTestAdblock(t, List{Name: "ads", Enabled: true}, "example.com\n", false)
+	if err := adblocker.LoadLocalLists(allowPath, blockPath); err != nil {
+		t.Fatal(err)
+	}
+	if !adblocker.CheckIfAppearsOnAdblockList("www.example.com") {
+		t.Error("Expected the list to block www.example.com")
+	}
+	if adblocker.CheckIfAppearsOnAdblockList("eu.dashboard.example.com") {
+		t.Error("Expected the allowlist to win over the list")
+	}
+
+	if err := adblocker.AddLocal(Blocklist, "*.Tracker.test"); err != nil {
+		t.Fatal(err)
+	}
+	if list, ok := adblocker.BlockedBy("cdn.tracker.test"); !ok || list != string(Blocklist) {
+		t.Errorf("Expected the blocklist to block cdn.tracker.test, got %q %v", list, ok)
+	}
+	if err := adblocker.AddLocal(Allowlist, "www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if adblocker.CheckIfAppearsOnAdblockList("www.example.com") {
+		t.Error("Expected the added allowlist entry to unblock www.example.com")
+	}
+	if err := adblocker.AddLocal(Allowlist, "https://example.com/"); err == nil {
+		t.Error("Expected URLs to be rejected")
+	}
+	for _, pattern := range []string{"*", "*.*", "*.com", "**.org."} {
+		if err := adblocker.AddLocal(Blocklist, pattern); err == nil {
+			t.Errorf("Expected %q to be rejected as too broad", pattern)
+		}
+	}
+
+	// Changes are saved and survive a reload
+	if err := adblocker.RemoveLocal(Allowlist, "dashboard.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := adblocker.RemoveLocal(Allowlist, "missing.example.com"); err == nil {
+		t.Error("Expected removing a missing pattern to fail")
+	}
+	if err := adblocker.LoadLocalLists(allowPath, blockPath); err != nil {
+		t.Fatal(err)
+	}
+	if patterns, _ := adblocker.LocalPatterns(Allowlist); !slices.Equal(patterns, []string{"www.example.com"}) {
+		t.Errorf("Unexpected allowlist %v", patterns)
+	}
+	if patterns, _ := adblocker.LocalPatterns(Blocklist); !slices.Equal(patterns, []string{"*.tracker.test"}) {
+		t.Errorf("Unexpected blocklist %v", patterns)
+	}
+	if data, _ := os.ReadFile(allowPath); string(data) != "# false positives\nwww.example.com\n" {
+		t.Errorf("Expected comments to be kept, got %q", data)
+	}
+	if !adblocker.CheckIfAppearsOnAdblockList("dashboard.example.com") {
+		t.Error("Expected the removed allowlist entry to be blocked again")
+	}
+
+	if err := os.WriteFile(blockPath, []byte("not a domain\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := adblocker.LoadLocalLists(allowPath, blockPath); err == nil {
+		t.Error("Expected invalid patterns to be rejected")
+	}
+}
@@ -0,0 +1,152 @@
+package adblock
+
+import (
+	"regexp"
+	"strings"
+
+	iradix "github.com/hashicorp/go-immutable-radix/v2"
+)
+
+// listRule is a merged rule and the list it came from
+type listRule struct {
+	list       string
+	subdomains bool
+}
+
+// listPattern is a wildcard rule, list is empty until the rules are merged
+type listPattern struct {
+	re   *regexp.Regexp
+	list string
+}
+
+// matcher holds the rules of several lists merged together. An exception only
+// unblocks hosts blocked by its own list.
+type matcher struct {
+	entries            *iradix.Tree[listRule] // keyed by hostKey
+	exceptions         *iradix.Tree[listRule]
+	wildcards          []listPattern
+	exceptionWildcards []listPattern
+	lists              []List // the merged lists, to scope exceptions
+}
+
+// newMatcher merges the rules of the enabled lists. When several lists have
+// the same host the first one is remembered, unless a later one also blocks
+// the subdomains.
+func newMatcher(lists []List) *matcher {
+	entries := iradix.New[listRule]().Txn()
+	exceptions := iradix.New[listRule]().Txn()
+	m := &matcher{}
+	for _, list := range lists {
+		if !list.Enabled || list.Rules == nil {
+			continue
+		}
+		m.lists = append(m.lists, list)
+		mergeTree(entries, list.Rules.Entries, list.Name)
+		mergeTree(exceptions, list.Rules.Exceptions, list.Name)
+		for _, p := range list.Rules.wildcards {
+			m.wildcards = append(m.wildcards, listPattern{p.re, list.Name})
+		}
+		for _, p := range list.Rules.exceptionWildcards {
+			m.exceptionWildcards = append(m.exceptionWildcards, listPattern{p.re, list.Name})
+		}
+	}
+	m.entries = entries.Commit()
+	m.exceptions = exceptions.Commit()
+	return m
+}
+
+func mergeTree(txn *iradix.Txn[listRule], tree *iradix.Tree[bool], list string) {
+	if tree == nil {
+		return
+	}
+	// Walk stops when fn returns true, so it can't be used with range
+	tree.Root().Walk(func(key []byte, subdomains bool) bool {
+		if old, ok := txn.Get(key); !ok || (!old.subdomains && subdomains) {
+			txn.Insert(key, listRule{list: list, subdomains: subdomains})
+		}
+		return false
+	})
+}
+
+// match returns the list blocking host, if any
+func (m *matcher) match(host string) (string, bool) {
+	key := hostKey(host)
+	rule, ok := matchTree(m.entries, key, listRule.coversSubdomains)
+	list := rule.list
+	if !ok {
+		if list, ok = matchPatterns(m.wildcards, host); !ok {
+			return "", false
+		}
+	}
+	_, excepted := matchTree(m.exceptions, key, listRule.coversSubdomains)
+	if !excepted {
+		if _, excepted = matchPatterns(m.exceptionWildcards, host); !excepted {
+			return list, true
+		}
+	}
+
+	// Some list has an exception for host, it only unblocks that list's rules
+	for _, l := range m.lists {
+		if l.Rules.blocks(key, host) && !l.Rules.unblocks(key, host) {
+			return l.Name, true
+		}
+	}
+	return "", false
+}
+
+func (m *matcher) len() int {
+	return m.entries.Len() + len(m.wildcards)
+}
+
+func (r listRule) coversSubdomains() bool {
+	return r.subdomains
+}
+
+// blocks reports whether the block rules of r cover host, key is its hostKey
+func (r *Rules) blocks(key []byte, host string) bool {
+	if _, ok := matchTree(r.Entries, key, coversSubdomains); ok {
+		return true
+	}
+	_, ok := matchPatterns(r.wildcards, host)
+	return ok
+}
+
+// unblocks reports whether the exceptions of r cover host
+func (r *Rules) unblocks(key []byte, host string) bool {
+	if _, ok := matchTree(r.Exceptions, key, coversSubdomains); ok {
+		return true
+	}
+	_, ok := matchPatterns(r.exceptionWildcards, host)
+	return ok
+}
+
+// coversSubdomains reads the values of Rules trees
+func coversSubdomains(subdomains bool) bool {
+	return subdomains
+}
+
+// matchTree looks for key or one of its parent domains in tree, subdomains
+// tells whether a value also covers the subdomains of its key
+func matchTree[T any](tree *iradix.Tree[T], key []byte, subdomains func(T) bool) (T, bool) {
+	var value T
+	found := false
+	// Visits the entries for host and each parent domain, e.g. net.doubleclick.
+	// for net.doubleclick.g.stats.
+	tree.Root().WalkPath(key, func(k []byte, v T) bool {
+		if subdomains(v) || len(k) == len(key) {
+			value, found = v, true
+		}
+		return found
+	})
+	return value, found
+}
+
+func matchPatterns(patterns []listPattern, host string) (string, bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, p := range patterns {
+		if p.re.MatchString(host) {
+			return p.list, true
+		}
+	}
+	return "", false
+}
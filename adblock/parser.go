@@ -0,0 +1,245 @@
+package adblock
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+
+	iradix "github.com/hashicorp/go-immutable-radix/v2"
+)
+
+// ListFormat is the syntax of a block list
+type ListFormat string
+
+const (
+	FormatHosts   ListFormat = "hosts"   // 0.0.0.0 ads.example.com
+	FormatDomains ListFormat = "domains" // ads.example.com
+	FormatDnsmasq ListFormat = "dnsmasq" // address=/ads.example.com/0.0.0.0
+	FormatABP     ListFormat = "abp"     // ||ads.example.com^ and @@||allowed.example.com^
+)
+
+// How many rule lines DetectListFormat looks at before settling on plain domains
+const detectLines = 100
+
+// DetectListFormat guesses the format of a block list from its first rules
+func DetectListFormat(data []byte) ListFormat {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for seen := 0; seen < detectLines && scanner.Scan(); {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "[Adblock"), strings.HasPrefix(line, "!"),
+			strings.HasPrefix(line, "||"), strings.HasPrefix(line, "@@"):
+			return FormatABP
+		case strings.HasPrefix(line, "address=/"):
+			return FormatDnsmasq
+		}
+		if fields := strings.Fields(line); len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+			return FormatHosts
+		}
+		seen++
+	}
+	return FormatDomains
+}
+
+// Rules are the parsed rules of one list
+type Rules struct {
+	Entries            *iradix.Tree[bool] // keyed by hostKey, true also blocks subdomains
+	Exceptions         *iradix.Tree[bool] // hosts unblocked by @@ rules, same layout as Entries
+	wildcards          []listPattern      // blocked host patterns
+	exceptionWildcards []listPattern      // unblocked host patterns
+}
+
+// Len returns how many block rules there are
+func (r *Rules) Len() int {
+	if r == nil {
+		return 0
+	}
+	return r.Entries.Len() + len(r.wildcards)
+}
+
+// ParseList reads a block list, detecting its format. Listed hosts block
+// their subdomains too unless exact is set; exact only applies to hosts and
+// plain domain lists, dnsmasq and ABP rules always cover subdomains.
+func ParseList(data []byte, exact bool) (*Rules, ListFormat, error) {
+	format := DetectListFormat(data)
+	b := &listBuilder{
+		entries:    iradix.New[bool]().Txn(),
+		exceptions: iradix.New[bool]().Txn(),
+	}
+
+	skipped := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var ok bool
+		switch format {
+		case FormatHosts:
+			ok = b.addHostsLine(line, exact)
+		case FormatDnsmasq:
+			ok = b.addDnsmasqLine(line)
+		case FormatABP:
+			ok = b.addABPLine(line)
+		default:
+			ok = b.addDomain(stripComment(line), !exact)
+		}
+		if !ok {
+			skipped++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, format, err
+	}
+
+	if skipped > 0 {
+		log.Printf("Skipped %d lines the %s parser doesn't support", skipped, format)
+	}
+	return &Rules{
+		Entries:            b.entries.Commit(),
+		Exceptions:         b.exceptions.Commit(),
+		wildcards:          b.wildcards,
+		exceptionWildcards: b.exceptionWildcards,
+	}, format, nil
+}
+
+type listBuilder struct {
+	entries            *iradix.Txn[bool]
+	exceptions         *iradix.Txn[bool]
+	wildcards          []listPattern
+	exceptionWildcards []listPattern
+}
+
+// addHostsLine reads "0.0.0.0 host [host...] [# comment]"
+func (b *listBuilder) addHostsLine(line string, exact bool) bool {
+	fields := strings.Fields(stripComment(line))
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return false
+	}
+	for _, host := range fields[1:] {
+		if !localHostsName(host) {
+			b.addDomain(host, !exact)
+		}
+	}
+	return true
+}
+
+// localHostsName reports whether a hosts file name belongs to the boilerplate
+// naming the local machine and network, which must never block a tree
+func localHostsName(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch host {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost":
+		return true
+	}
+	return strings.HasPrefix(host, "ip6-") || net.ParseIP(host) != nil
+}
+
+// addDnsmasqLine reads "address=/domain[/domain...]/[ip]", other dnsmasq
+// options don't block anything
+func (b *listBuilder) addDnsmasqLine(line string) bool {
+	rest, ok := strings.CutPrefix(stripComment(line), "address=/")
+	if !ok {
+		return false
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) < 2 {
+		return false
+	}
+	added := false
+	for _, domain := range parts[:len(parts)-1] { // the last part is the address
+		added = b.addDomain(domain, true) || added
+	}
+	return added
+}
+
+// Options that still apply to the whole domain, rules with any other option
+// only block some requests and are skipped
+var abpDomainOptions = map[string]bool{"important": true, "all": true, "document": true, "doc": true}
+
+// addABPLine reads the domain level subset of AdBlock Plus syntax:
+// ||domain^, @@||domain^ exceptions and * wildcards in the domain
+func (b *listBuilder) addABPLine(line string) bool {
+	if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return true // comments and the header
+	}
+
+	rule, exception := strings.CutPrefix(line, "@@")
+	rule, options, _ := strings.Cut(rule, "$")
+	if options != "" {
+		for _, option := range strings.Split(options, ",") {
+			if !abpDomainOptions[option] {
+				return false
+			}
+		}
+	}
+	domain, ok := strings.CutPrefix(rule, "||")
+	if !ok {
+		return false
+	}
+	domain = strings.TrimSuffix(strings.TrimSuffix(domain, "|"), "^")
+	if !validDomain(domain, true) {
+		return false
+	}
+
+	if strings.Contains(domain, "*") {
+		p := listPattern{re: wildcardRegexp(domain)}
+		if exception {
+			b.exceptionWildcards = append(b.exceptionWildcards, p)
+		} else {
+			b.wildcards = append(b.wildcards, p)
+		}
+		return true
+	}
+	if exception {
+		b.exceptions.Insert(hostKey(domain), true)
+	} else {
+		b.entries.Insert(hostKey(domain), true)
+	}
+	return true
+}
+
+// wildcardRegexp compiles a domain with * wildcards. Like ||domain^, it
+// matches the host or any subdomain.
+func wildcardRegexp(domain string) *regexp.Regexp {
+	pattern := strings.ReplaceAll(regexp.QuoteMeta(strings.ToLower(domain)), `\*`, `.*`)
+	return regexp.MustCompile(`^(?:.*\.)?` + pattern + `$`)
+}
+
+func (b *listBuilder) addDomain(domain string, subdomains bool) bool {
+	if !validDomain(domain, false) {
+		return false
+	}
+	b.entries.Insert(hostKey(domain), subdomains)
+	return true
+}
+
+func stripComment(line string) string {
+	line, _, _ = strings.Cut(line, "#")
+	return strings.TrimSpace(line)
+}
+
+// validDomain rejects anything that isn't a bare host name, like URLs or
+// paths that only block part of a site
+func validDomain(domain string, wildcards bool) bool {
+	if domain == "" || strings.HasPrefix(domain, ".") {
+		return false
+	}
+	for _, c := range domain {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '.', c == '-', c == '_':
+		case c == '*' && wildcards:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package adblock
+
+import "testing"
+
+func TestParseListFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		format  ListFormat
+		blocked []string
+		allowed []string
+	}{
+		{
+			name:    "hosts",
+			list:    "# hosts\n127.0.0.1 localhost\n0.0.0.0 ads.example.com tracker.example.com # two hosts\n",
+			format:  FormatHosts,
+			blocked: []string{"ads.example.com", "tracker.example.com", "cdn.ads.example.com"},
+			allowed: []string{"example.com"},
+		},
+		{
+			name:    "domains",
+			list:    "# plain\nads.example.com\ntracker.example.com # inline\nnot a domain\n",
+			format:  FormatDomains,
+			blocked: []string{"ads.example.com", "tracker.example.com", "x.tracker.example.com"},
+			allowed: []string{"example.com", "not"},
+		},
+		{
+			name:    "dnsmasq",
+			list:    "# dnsmasq\naddress=/ads.example.com/0.0.0.0\naddress=/a.test/b.test/\nserver=/corp.example/10.0.0.1\n",
+			format:  FormatDnsmasq,
+			blocked: []string{"ads.example.com", "x.ads.example.com", "a.test", "b.test"},
+			allowed: []string{"corp.example", "example.com"},
+		},
+		{
+			name: "abp",
+			list: "[Adblock Plus 2.0]\n! comment\n||example.com^\n@@||dashboard.example.com^\n||ads*.example.net^$important\n" +
+				"||tracker.test^$third-party\n||site.test/path^\nexample.org##.banner\n",
+			format:  FormatABP,
+			blocked: []string{"example.com", "www.example.com", "ads1.example.net", "cdn.ads-eu.example.net"},
+			allowed: []string{"dashboard.example.com", "x.dashboard.example.com", "example.net", "tracker.test", "site.test", "example.org"},
+		},
+	}
+
+	for _, tt := range tests {
+		rules, format, err := ParseList([]byte(tt.list), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adblocker := newAdblock([]List{{Name: tt.name, Enabled: true, Rules: rules}})
+		if format != tt.format {
+			t.Errorf("%s: expected format %s, got %s", tt.name, tt.format, format)
+		}
+		for _, host := range tt.blocked {
+			if !adblocker.CheckIfAppearsOnAdblockList(host) {
+				t.Errorf("%s: expected %s to be blocked", tt.name, host)
+			}
+		}
+		for _, host := range tt.allowed {
+			if adblocker.CheckIfAppearsOnAdblockList(host) {
+				t.Errorf("%s: expected %s not to be blocked", tt.name, host)
+			}
+		}
+	}
+}
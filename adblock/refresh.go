@@ -0,0 +1,87 @@
+package adblock
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+)
+
+// Refresh downloads the lists again, asking the servers whether they
+// changed, and swaps in the ones that did. It returns how many changed.
+func (a *AdBlocker) Refresh() int {
+	a.mu.RLock()
+	lists, cacheDir, pacparser := slices.Clone(a.lists), a.cacheDir, a.pacparser
+	a.mu.RUnlock()
+
+	type listID struct{ name, url string }
+	updated := map[listID]List{}
+	for _, list := range lists {
+		source := list.source
+		if list.Rules == nil {
+			source = listSource{URL: list.URL} // nothing to revalidate
+		}
+		data, fetched, err := fetchList(source, pacparser)
+		if err != nil {
+			log.Printf("Failed to refresh block list %s, keeping the current one: %v", list.URL, err)
+			continue
+		}
+		if data == nil {
+			continue // not modified
+		}
+		rules := parseListData(list.URL, data, list.Exact)
+		if rules == nil {
+			continue
+		}
+		if err := saveCachedList(cacheDir, fetched, data); err != nil {
+			log.Println(err)
+		}
+		list.Rules, list.source = rules, fetched
+		updated[listID{list.Name, list.URL}] = list
+	}
+	if len(updated) == 0 {
+		return 0
+	}
+
+	// Categories may have been toggled meanwhile, only the rules are swapped
+	a.update(func(lists []List) {
+		for i := range lists {
+			if list, ok := updated[listID{lists[i].Name, lists[i].URL}]; ok {
+				lists[i].Rules, lists[i].source = list.Rules, list.source
+			}
+		}
+	})
+	return len(updated)
+}
+
+// SetRefreshInterval refreshes the lists every interval in the background,
+// replacing any previous schedule. 0 stops refreshing.
+func (a *AdBlocker) SetRefreshInterval(interval time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopRefresh != nil {
+		a.stopRefresh()
+		a.stopRefresh = nil
+	}
+	if interval <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.stopRefresh = cancel
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if changed := a.Refresh(); changed > 0 {
+				log.Printf("Refreshed %d adblock lists", changed)
+			}
+		}
+	}()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/LucasSnatiago/GoProxy/config"
+	"github.com/LucasSnatiago/GoProxy/pac"
+)
+
+const commandUsage = `Usage: goproxy [flags] pac test <url>...
+  pac test    show how the PAC routes each url, like http://goproxy/explain`
+
+// runCommand runs a command given after the flags and returns the exit code
+func runCommand(cfg *config.Config, args []string) int {
+	if len(args) < 3 || args[0] != "pac" || args[1] != "test" {
+		fmt.Println(commandUsage)
+		return 1
+	}
+
+	pacparser, err := newPac(cfg)
+	if err != nil {
+		fmt.Println("Failed to load PAC:", err)
+		return 2
+	}
+	defer pacparser.Close()
+
+	code := 0
+	for i, target := range args[2:] {
+		if i > 0 {
+			fmt.Println()
+		}
+		explanation, err := pac.Explain(target, pacparser)
+		if err != nil {
+			fmt.Printf("Failed to explain %s: %v\n", target, err)
+			code = 1
+			continue
+		}
+		fmt.Print(explanation)
+	}
+	return code
+}
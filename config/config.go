@@ -0,0 +1,207 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every GoProxy setting. Values are layered: defaults, then the
+// config file, then GOPROXY_* environment variables, then command line flags.
+type Config struct {
+	Listen    string `yaml:"listen"`     // ip to listen on
+	HTTPPort  int    `yaml:"http_port"`  // 0 disables the HTTP listener
+	SocksPort int    `yaml:"socks_port"` // 0 disables the SOCKS5 listener
+
+	PAC struct {
+		URL      string        `yaml:"url"`       // Proxy Auto Configuration URL
+		CacheTTL time.Duration `yaml:"cache_ttl"` // how long PAC answers are cached, e.g. "5m"
+		Refresh  time.Duration `yaml:"refresh"`   // how often the PAC is downloaded again, 0 disables
+		CacheDir string        `yaml:"cache_dir"` // where the last downloaded PAC is kept, "" disables it
+
+		EvalTimeout   time.Duration `yaml:"eval_timeout"`    // longest a FindProxyForURL call may run, 0 disables
+		DefaultRoute  string        `yaml:"default_route"`   // used when the PAC fails or times out
+		MaxScriptSize int64         `yaml:"max_script_size"` // largest PAC accepted, in bytes
+		CacheKey      string        `yaml:"cache_key"`       // auto, host, origin (scheme+host+port) or url
+	} `yaml:"pac"`
+
+	Adblock struct {
+		Enabled bool          `yaml:"enabled"`
+		URL     string        `yaml:"url"`   // hosts file, plain domains, dnsmasq or AdBlock Plus list, used when lists is empty
+		Exact   bool          `yaml:"exact"` // block only the listed hosts, not their subdomains
+		Lists   []AdblockList `yaml:"lists"`
+
+		Refresh  time.Duration `yaml:"refresh"`   // how often the lists are downloaded again, 0 disables
+		CacheDir string        `yaml:"cache_dir"` // where the last downloaded lists are kept, "" disables it
+
+		Allowlist string `yaml:"allowlist"` // file of domains never blocked, checked before the lists
+		Blocklist string `yaml:"blocklist"` // file of domains always blocked, checked before the lists
+	} `yaml:"adblock"`
+
+	Auth struct {
+		UpstreamUser     string `yaml:"upstream_user"` // credentials for the upstream proxies
+		UpstreamPassword string `yaml:"upstream_password"`
+		Htpasswd         string `yaml:"htpasswd"` // users allowed to use GoProxy
+	} `yaml:"auth"`
+
+	Log struct {
+		Verbose bool   `yaml:"verbose"` // log every request
+		File    string `yaml:"file"`    // write logs here instead of stderr, even when not verbose
+	} `yaml:"log"`
+}
+
+// AdblockList is one of several block lists
+type AdblockList struct {
+	Name     string `yaml:"name"`
+	URL      string `yaml:"url"`
+	Category string `yaml:"category"` // ads, malware, social, gambling or any other name
+	Enabled  bool   `yaml:"enabled"`  // true when missing
+	Exact    bool   `yaml:"exact"`    // block only the listed hosts, not their subdomains
+}
+
+// UnmarshalYAML fills in the defaults of the keys left out of a list
+func (l *AdblockList) UnmarshalYAML(node *yaml.Node) error {
+	type plain AdblockList // without this method, so Decode doesn't recurse
+	list := plain{Category: "ads", Enabled: true}
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	if list.URL == "" {
+		return fmt.Errorf("line %d: adblock list %q has no url", node.Line, list.Name)
+	}
+	if list.Name == "" {
+		list.Name = list.URL
+	}
+	*l = AdblockList(list)
+	return nil
+}
+
+// AdblockLists returns adblock.lists, or adblock.url as a single list named
+// "default" when there are none
+func (c *Config) AdblockLists() []AdblockList {
+	if len(c.Adblock.Lists) > 0 || c.Adblock.URL == "" {
+		return c.Adblock.Lists
+	}
+	return []AdblockList{{Name: "default", URL: c.Adblock.URL, Category: "ads", Enabled: true, Exact: c.Adblock.Exact}}
+}
+
+// Default returns the settings GoProxy uses when nothing else is configured
+func Default() *Config {
+	c := &Config{
+		Listen:    "localhost",
+		HTTPPort:  3128,
+		SocksPort: 8010,
+	}
+	c.PAC.URL = "http://wpad/wpad.dat"
+	c.PAC.CacheTTL = 5 * time.Minute
+	c.PAC.Refresh = time.Hour
+	c.PAC.CacheDir = defaultCacheDir()
+	c.PAC.EvalTimeout = 2 * time.Second
+	c.PAC.DefaultRoute = "DIRECT"
+	c.PAC.MaxScriptSize = 2 << 20 // 2 MiB
+	c.PAC.CacheKey = "auto"
+	c.Adblock.Refresh = 24 * time.Hour
+	c.Adblock.CacheDir = defaultCacheDir()
+	c.Adblock.URL = "https://raw.githubusercontent.com/StevenBlack/hosts/master/alternates/fakenews-gambling-porn/hosts"
+	return c
+}
+
+// defaultCacheDir prefers the directory systemd creates for CacheDirectory=
+func defaultCacheDir() string {
+	if dir := os.Getenv("CACHE_DIRECTORY"); dir != "" {
+		return dir
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "goproxy")
+	}
+	return ""
+}
+
+// Load reads a YAML config file on top of the defaults
+func Load(path string) (*Config, error) {
+	c := Default()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	defer file.Close()
+
+	// Typos in the file should fail loudly instead of being ignored
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// ApplyEnv overrides settings with GOPROXY_* variables found by lookup,
+// usually os.LookupEnv
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	str := func(name string, dst *string) {
+		if v, ok := lookup(name); ok {
+			*dst = v
+		}
+	}
+	var err error
+	num := func(name string, dst *int) {
+		if v, ok := lookup(name); ok && err == nil {
+			if *dst, err = strconv.Atoi(v); err != nil {
+				err = fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+	num64 := func(name string, dst *int64) {
+		if v, ok := lookup(name); ok && err == nil {
+			if *dst, err = strconv.ParseInt(v, 10, 64); err != nil {
+				err = fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v, ok := lookup(name); ok && err == nil {
+			if *dst, err = strconv.ParseBool(v); err != nil {
+				err = fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+	duration := func(name string, dst *time.Duration) {
+		if v, ok := lookup(name); ok && err == nil {
+			if *dst, err = time.ParseDuration(v); err != nil {
+				err = fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+
+	str("GOPROXY_LISTEN", &c.Listen)
+	num("GOPROXY_HTTP_PORT", &c.HTTPPort)
+	num("GOPROXY_SOCKS_PORT", &c.SocksPort)
+	str("GOPROXY_PAC_URL", &c.PAC.URL)
+	duration("GOPROXY_PAC_CACHE_TTL", &c.PAC.CacheTTL)
+	duration("GOPROXY_PAC_REFRESH", &c.PAC.Refresh)
+	str("GOPROXY_PAC_CACHE_DIR", &c.PAC.CacheDir)
+	duration("GOPROXY_PAC_EVAL_TIMEOUT", &c.PAC.EvalTimeout)
+	str("GOPROXY_PAC_DEFAULT_ROUTE", &c.PAC.DefaultRoute)
+	num64("GOPROXY_PAC_MAX_SCRIPT_SIZE", &c.PAC.MaxScriptSize)
+	str("GOPROXY_PAC_CACHE_KEY", &c.PAC.CacheKey)
+	boolean("GOPROXY_ADBLOCK", &c.Adblock.Enabled)
+	str("GOPROXY_ADBLOCK_URL", &c.Adblock.URL)
+	boolean("GOPROXY_ADBLOCK_EXACT", &c.Adblock.Exact)
+	duration("GOPROXY_ADBLOCK_REFRESH", &c.Adblock.Refresh)
+	str("GOPROXY_ADBLOCK_CACHE_DIR", &c.Adblock.CacheDir)
+	str("GOPROXY_ADBLOCK_ALLOWLIST", &c.Adblock.Allowlist)
+	str("GOPROXY_ADBLOCK_BLOCKLIST", &c.Adblock.Blocklist)
+	str("GOPROXY_UPSTREAM_USER", &c.Auth.UpstreamUser)
+	str("GOPROXY_UPSTREAM_PASSWORD", &c.Auth.UpstreamPassword)
+	str("GOPROXY_HTPASSWD", &c.Auth.Htpasswd)
+	boolean("GOPROXY_VERBOSE", &c.Log.Verbose)
+	str("GOPROXY_LOG_FILE", &c.Log.File)
+	return err
+}
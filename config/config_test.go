@@ -0,0 +1,68 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLoadAndApplyEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "http_port: 8080\npac:\n  url: http://pac.example/proxy.pac\n  cache_ttl: 1m\nadblock:\n  enabled: true\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTPPort != 8080 || c.PAC.CacheTTL != time.Minute || !c.Adblock.Enabled {
+		t.Errorf("Expected file values to be loaded, got %+v", c)
+	}
+	if c.SocksPort != 8010 {
+		t.Errorf("Expected defaults for missing keys, got socks port %d", c.SocksPort)
+	}
+
+	if lists := c.AdblockLists(); len(lists) != 1 || lists[0].URL != c.Adblock.URL {
+		t.Errorf("Expected adblock.url as the only list, got %+v", lists)
+	}
+
+	env := map[string]string{"GOPROXY_PAC_URL": "http://other/proxy.pac", "GOPROXY_SOCKS_PORT": "0"}
+	if err := c.ApplyEnv(func(k string) (string, bool) { v, ok := env[k]; return v, ok }); err != nil {
+		t.Fatal(err)
+	}
+	if c.PAC.URL != "http://other/proxy.pac" || c.SocksPort != 0 || c.HTTPPort != 8080 {
+		t.Errorf("Expected environment to override the file, got %+v", c)
+	}
+
+	env = map[string]string{"GOPROXY_HTTP_PORT": "http"}
+	if err := c.ApplyEnv(func(k string) (string, bool) { v, ok := env[k]; return v, ok }); err == nil {
+		t.Errorf("Expected invalid port to fail")
+	}
+
+	content = "adblock:\n  lists:\n    - name: malware\n      url: http://lists.example/malware.txt\n      category: malware\n" +
+		"    - url: http://lists.example/social.txt\n      enabled: false\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = Load(path); err != nil {
+		t.Fatal(err)
+	}
+	want := []AdblockList{
+		{Name: "malware", URL: "http://lists.example/malware.txt", Category: "malware", Enabled: true},
+		{Name: "http://lists.example/social.txt", URL: "http://lists.example/social.txt", Category: "ads"},
+	}
+	if lists := c.AdblockLists(); !slices.Equal(lists, want) {
+		t.Errorf("Expected %+v, got %+v", want, lists)
+	}
+
+	if err := os.WriteFile(path, []byte("htp_port: 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Errorf("Expected unknown keys to be rejected")
+	}
+}
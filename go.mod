@@ -3,15 +3,17 @@ module github.com/LucasSnatiago/GoProxy
 go 1.25.0
 
 require (
-	github.com/LucasSnatiago/gopac v0.0.0-20250728195731-73250337d53a
 	github.com/hashicorp/go-immutable-radix/v2 v2.1.0
 	github.com/hashicorp/golang-lru/v2 v2.0.7
+	github.com/robertkrimen/otto v0.5.1
 	github.com/things-go/go-socks5 v0.1.1
+	golang.org/x/crypto v0.51.0
 	golang.org/x/net v0.53.0
+	golang.org/x/sync v0.22.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/robertkrimen/otto v0.5.1 // indirect
-	golang.org/x/text v0.36.0 // indirect
+	golang.org/x/text v0.37.0 // indirect
 	gopkg.in/sourcemap.v1 v1.0.5 // indirect
 )
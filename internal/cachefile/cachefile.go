@@ -0,0 +1,43 @@
+// Package cachefile keeps the last download of a URL on disk, for the PAC and
+// the adblock lists alike
+package cachefile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Path is where the last download of url is kept in dir, named prefix, a
+// hash of url and ext
+func Path(dir, prefix, url, ext string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(dir, prefix+hex.EncodeToString(sum[:8])+ext)
+}
+
+// WriteAtomic writes data next to path and renames it, so a crash never
+// leaves half a file behind
+func WriteAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".goproxy-*")
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	return nil
+}
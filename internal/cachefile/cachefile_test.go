@@ -0,0 +1,31 @@
+package cachefile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := Path(dir, "list-", "https://example.com/hosts", ".txt")
+	if path != Path(dir, "list-", "https://example.com/hosts", ".txt") || path == Path(dir, "list-", "https://example.com/other", ".txt") {
+		t.Errorf("Expected one path per URL, got %s", path)
+	}
+
+	for _, data := range []string{"first\n", "second\n"} {
+		if err := WriteAtomic(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile(path); string(got) != data {
+			t.Errorf("Expected %q, got %q", data, got)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected no temporary files left behind, got %v", entries)
+	}
+
+	if err := WriteAtomic(filepath.Join(dir, "missing", "file"), nil); err == nil {
+		t.Error("Expected a missing directory to fail")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -13,6 +14,7 @@ import (
 	"time"
 
 	"github.com/LucasSnatiago/GoProxy/adblock"
+	"github.com/LucasSnatiago/GoProxy/config"
 	"github.com/LucasSnatiago/GoProxy/pac"
 	"github.com/LucasSnatiago/GoProxy/proxyhandler"
 	"github.com/things-go/go-socks5"
@@ -20,97 +22,253 @@ import (
 
 func main() {
 	log.SetFlags(log.Lshortfile)
-	pacUrl := flag.String("C", "http://wpad/wpad.dat", "Proxy Auto Configuration URL")
-	listenAddr := flag.String("l", "localhost", "ip to listen on")
-	httpPort := flag.Int("p", 3128, "HTTP/HTTPS port to listen on")
-	socksPort := flag.Int("s", 8010, "SOCKS5 port to listen on")
-	username := flag.String("user", "", "username for authentication")
-	password := flag.String("pass", "", "password for authentication")
-	ttlSeconds := flag.Int64("S", 5*60, "sets how long (in seconds) for the cache to keep the entries - default is 5 minutes")
-	logMessages := flag.Bool("v", false, "if you set this flag it will enable console output for every request")
-	adblockLink := flag.String("A", "https://raw.githubusercontent.com/StevenBlack/hosts/master/alternates/fakenews-gambling-porn/hosts", "adblock list to be used")
-	adblockEnabled := flag.Bool("a", false, "enable adblock usage on the proxy")
-	displayVersion := flag.Bool("version", false, "display GoProxy current version")
-	flag.Parse()
-
-	// Display version and exit
-	if *displayVersion {
-		fmt.Println(DisplayVersion())
-		os.Exit(0)
+	configFile, applyFlags := parseFlags()
+	cfg, err := buildConfig(configFile, applyFlags)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
-	// Disabling log messages
-	if !*logMessages {
-		log.SetOutput(io.Discard)
+	if err := setupLogging(cfg); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
 	// Pac file is mandatory
-	if pacUrl == nil || *pacUrl == "" {
+	if cfg.PAC.URL == "" {
 		fmt.Println("Please specify pac url using -C")
 		os.Exit(1)
 	}
 
+	// Commands such as "pac test" run instead of the proxy
+	if args := flag.Args(); len(args) > 0 {
+		os.Exit(runCommand(cfg, args))
+	}
+
 	// Proxy Auto Config
-	pacScript, err := pac.DownloadPAC(*pacUrl)
+	pacparser, err := newPac(cfg)
 	if err != nil {
-		fmt.Println("Failed to parse PAC:", err)
+		fmt.Println("Failed to load PAC:", err)
 		os.Exit(2)
 	}
+	pacparser.SetRefreshInterval(cfg.PAC.Refresh)
+	go pacparser.LogStats(context.Background(), time.Minute)
+	pacparser.SetAuth(cfg.Auth.UpstreamUser, cfg.Auth.UpstreamPassword)
 
-	pacparser, err := pac.NewPac(pacScript, time.Second*time.Duration(*ttlSeconds))
-	if err != nil {
-		fmt.Println("Failed to create pac parser:", err)
-		os.Exit(3)
+	// Client authentication
+	var creds *proxyhandler.Credentials
+	if cfg.Auth.Htpasswd != "" {
+		creds, err = proxyhandler.LoadCredentials(cfg.Auth.Htpasswd)
+		if err != nil {
+			fmt.Println("Failed to load client credentials:", err)
+			os.Exit(5)
+		}
 	}
-	pacparser.SetAuth(*username, *password)
 
 	fmt.Println("Running GoProxy version:", version)
 
-	// Adblock
-	var adblocker *adblock.AdBlocker
-	if *adblockEnabled && adblockLink != nil && *adblockLink != "" {
-		adblocker = adblock.NewAdblock(*adblockLink, pacparser)
-		if adblocker == nil {
-			fmt.Println("AdBlock is disabled, something went wrong.")
-		} else {
-			log.Println("Adblock up and running")
+	// Adblock, off until enabled and filled, also on reload
+	adblocker := adblock.NewDisabledAdblock()
+	if cfg.Adblock.Enabled {
+		adblocker.SetEnabled(true)
+		if lists := adblockLists(cfg); len(lists) > 0 {
+			adblocker.Replace(adblock.NewAdblock(lists, cfg.Adblock.CacheDir, pacparser))
+			if adblocker.Len() == 0 {
+				fmt.Println("AdBlock is disabled, something went wrong.")
+			} else {
+				log.Println("Adblock up and running")
+			}
+		}
+		if err := adblocker.LoadLocalLists(cfg.Adblock.Allowlist, cfg.Adblock.Blocklist); err != nil {
+			fmt.Println("Failed to load the local adblock lists:", err)
+			os.Exit(6)
 		}
+		adblocker.SetRefreshInterval(cfg.Adblock.Refresh)
 	}
 
-	httpAddr := net.JoinHostPort(*listenAddr, fmt.Sprint(*httpPort))
-
 	// Proxy HTTP
-	fmt.Println("Proxy HTTP listening on", httpAddr)
-	go func() {
-		err = http.ListenAndServe(httpAddr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			proxyhandler.HandleHTTPConnection(w, r, pacparser, adblocker)
-		}))
-	}()
-	// If fail to start HTTP server, exit
-	if err != nil {
-		fmt.Println("Failed to start http proxy:", err)
-		os.Exit(4)
+	if cfg.HTTPPort != 0 {
+		httpAddr := net.JoinHostPort(cfg.Listen, fmt.Sprint(cfg.HTTPPort))
+		fmt.Println("Proxy HTTP listening on", httpAddr)
+		go func() {
+			err := http.ListenAndServe(httpAddr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				proxyhandler.HandleHTTPConnection(w, r, pacparser, adblocker, creds)
+			}))
+			// If fail to start HTTP server, exit
+			fmt.Println("Failed to start http proxy:", err)
+			os.Exit(4)
+		}()
 	}
 
 	// Socks5
-	go func() {
-		socks5addr := net.JoinHostPort(*listenAddr, fmt.Sprint(*socksPort))
-		server := socks5.NewServer(
-			socks5.WithLogger(socks5.NewLogger(log.New(os.Stdout, "[SOCKS5] ", log.Lshortfile))),
-			socks5.WithDial(proxyhandler.HttpConnectDialer(httpAddr, time.Second*300)),
-		)
-
-		fmt.Println("Proxy SOCKS5 listening on", socks5addr)
-		err = server.ListenAndServe("tcp", socks5addr)
-		if err != nil {
-			fmt.Println("failed to start socks5 server:", err)
-		}
-	}()
+	if cfg.SocksPort != 0 {
+		go func() {
+			socks5addr := net.JoinHostPort(cfg.Listen, fmt.Sprint(cfg.SocksPort))
+			options := []socks5.Option{
+				socks5.WithLogger(socks5.NewLogger(log.New(os.Stdout, "[SOCKS5] ", log.Lshortfile))),
+				socks5.WithResolver(proxyhandler.SocksResolver{}),
+				socks5.WithDial(proxyhandler.SocksDialer(pacparser, adblocker)),
+				socks5.WithAssociateHandle(proxyhandler.SocksAssociateHandler(pacparser, adblocker)),
+			}
+			if creds != nil {
+				options = append(options, socks5.WithCredential(creds))
+			}
+			server := socks5.NewServer(options...)
+
+			fmt.Println("Proxy SOCKS5 listening on", socks5addr)
+			err := server.ListenAndServe("tcp", socks5addr)
+			if err != nil {
+				fmt.Println("failed to start socks5 server:", err)
+			}
+		}()
+	}
 
-	// Use CTRL + C to stop process
+	// SIGHUP reloads the configuration, anything else stops the process
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	fmt.Println("Program running. Press Ctrl+C to stop.")
-	<-sigChan
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		fmt.Println("Received SIGHUP. Reloading configuration...")
+		cfg = reload(cfg, configFile, applyFlags, pacparser, adblocker, creds)
+	}
 	fmt.Println("Received Ctrl+C. Turning off...")
 }
+
+// newPac loads the PAC with the settings from cfg
+func newPac(cfg *config.Config) (*pac.Pac, error) {
+	cacheKeyMode, err := pac.ParseCacheKeyMode(cfg.PAC.CacheKey)
+	if err != nil {
+		return nil, err
+	}
+	pacparser, err := pac.NewPacFromURL(cfg.PAC.URL, cfg.PAC.CacheTTL, cfg.PAC.CacheDir, cfg.PAC.MaxScriptSize)
+	if err != nil {
+		return nil, err
+	}
+	pacparser.SetEvalLimits(cfg.PAC.EvalTimeout, cfg.PAC.DefaultRoute)
+	pacparser.SetCacheKeyMode(cacheKeyMode)
+	return pacparser, nil
+}
+
+// adblockLists returns the configured block lists
+func adblockLists(cfg *config.Config) []adblock.List {
+	var lists []adblock.List
+	for _, list := range cfg.AdblockLists() {
+		lists = append(lists, adblock.List{
+			Name:     list.Name,
+			URL:      list.URL,
+			Category: list.Category,
+			Enabled:  list.Enabled,
+			Exact:    list.Exact,
+		})
+	}
+	return lists
+}
+
+// parseFlags returns the config file to read and a function applying the
+// command line flags that were explicitly set
+func parseFlags() (string, func(*config.Config)) {
+	defaults := config.Default()
+	configFile := flag.String("config", "", "YAML config file, also read from GOPROXY_CONFIG")
+	pacUrl := flag.String("C", defaults.PAC.URL, "Proxy Auto Configuration URL, file path, data: URL or \"auto\" for WPAD discovery")
+	listenAddr := flag.String("l", defaults.Listen, "ip to listen on")
+	httpPort := flag.Int("p", defaults.HTTPPort, "HTTP/HTTPS port to listen on, 0 disables the HTTP listener")
+	socksPort := flag.Int("s", defaults.SocksPort, "SOCKS5 port to listen on, 0 disables the SOCKS5 listener")
+	username := flag.String("user", "", "username for upstream proxy authentication")
+	password := flag.String("pass", "", "password for upstream proxy authentication")
+	htpasswdFile := flag.String("htpasswd", "", "htpasswd file (bcrypt) with the users allowed to use GoProxy, leave empty to disable client authentication")
+	ttlSeconds := flag.Int64("S", int64(defaults.PAC.CacheTTL/time.Second), "sets how long (in seconds) for the cache to keep the entries - default is 5 minutes")
+	logMessages := flag.Bool("v", false, "if you set this flag it will enable console output for every request")
+	adblockLink := flag.String("A", defaults.Adblock.URL, "adblock list to be used, the config file can have several")
+	adblockEnabled := flag.Bool("a", false, "enable adblock usage on the proxy")
+	displayVersion := flag.Bool("version", false, "display GoProxy current version")
+	flag.Parse()
+
+	// Display version and exit
+	if *displayVersion {
+		fmt.Println(DisplayVersion())
+		os.Exit(0)
+	}
+
+	if *configFile == "" {
+		*configFile = os.Getenv("GOPROXY_CONFIG")
+	}
+
+	// Only flags given on the command line win over the file and environment
+	applyFlags := func(cfg *config.Config) {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "C":
+				cfg.PAC.URL = *pacUrl
+			case "l":
+				cfg.Listen = *listenAddr
+			case "p":
+				cfg.HTTPPort = *httpPort
+			case "s":
+				cfg.SocksPort = *socksPort
+			case "user":
+				cfg.Auth.UpstreamUser = *username
+			case "pass":
+				cfg.Auth.UpstreamPassword = *password
+			case "htpasswd":
+				cfg.Auth.Htpasswd = *htpasswdFile
+			case "S":
+				cfg.PAC.CacheTTL = time.Second * time.Duration(*ttlSeconds)
+			case "v":
+				cfg.Log.Verbose = *logMessages
+			case "A":
+				cfg.Adblock.URL = *adblockLink
+			case "a":
+				cfg.Adblock.Enabled = *adblockEnabled
+			}
+		})
+	}
+	return *configFile, applyFlags
+}
+
+// buildConfig layers the defaults, the config file, GOPROXY_* environment
+// variables and the command line flags, in that order
+func buildConfig(configFile string, applyFlags func(*config.Config)) (*config.Config, error) {
+	cfg := config.Default()
+	if configFile != "" {
+		var err error
+		if cfg, err = config.Load(configFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, fmt.Errorf("failed to read environment: %w", err)
+	}
+	applyFlags(cfg)
+	return cfg, nil
+}
+
+// Log file currently in use, reopened on every reload so rotation works
+var logFile *os.File
+
+// setupLogging sends log messages to the configured file, or to stderr when
+// verbose, or nowhere
+func setupLogging(cfg *config.Config) error {
+	var output io.Writer = io.Discard
+	var file *os.File
+	if cfg.Log.File != "" {
+		var err error
+		file, err = os.OpenFile(cfg.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		output = file
+	} else if cfg.Log.Verbose {
+		output = os.Stderr
+	}
+
+	// SetOutput waits for pending writes, so the old file can be closed after
+	log.SetOutput(output)
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = file
+	return nil
+}
@@ -1,85 +1,106 @@
 package pac
 
 import (
-	"fmt"
 	"log"
-	"net"
 	"net/url"
 	"strings"
-	"sync/atomic"
 	"time"
 
-	"github.com/LucasSnatiago/gopac"
+	lru "github.com/hashicorp/golang-lru/v2"
 )
 
-var (
-	cacheHits   uint64
-	cacheMisses uint64
-)
+// Caching a thousand most recent visited sites
+const pacCacheSize = 1000
+
+// How long the default route is cached for a host whose evaluation failed or
+// timed out, so the PAC gets another chance soon
+var failedEvalTTL = 5 * time.Second
+
+// cacheEntry is a PAC answer. Past expires it is still served for another
+// TTL while a refresh runs, past staleUntil it counts as a miss.
+type cacheEntry struct {
+	value      string
+	expires    time.Time
+	staleUntil time.Time
+}
+
+func newPacCache(stats *cacheCounters) *lru.Cache[string, cacheEntry] {
+	// only fails for a non-positive size
+	cache, _ := lru.NewWithEvict(pacCacheSize, func(string, cacheEntry) {
+		stats.evictions.Add(1)
+	})
+	return cache
+}
 
 // It tries to retrieve the URL from the cache if it fails it calls an OttoVM
-// and retrieves the url directly from the proxy
+// and retrieves the url directly from the proxy. IP literals, bracketed IPv6
+// included, go through the PAC like host names so isInNet rules apply.
 func GetFromCache(rawUrl string, pac *Pac) string {
 	url, err := url.Parse(rawUrl)
 	if err != nil {
 		log.Println("failed to parse url: ", rawUrl)
+		return "DIRECT"
 	}
 
-	// Remove port if it exists
-	target, _, err := net.SplitHostPort(url.Host)
-	if err != nil {
-		target = url.Host // If no port is specified, use the whole host
-	}
+	// Hostname drops the port and the brackets around IPv6 addresses
+	target := url.Hostname()
 
 	// Do not cache empty targets
 	if strings.TrimSpace(target) == "" {
 		return "DIRECT"
 	}
 
-	// Check if its an IP address and skip the cache
-	ip := net.ParseIP(target)
-	if ip != nil {
-		return fmt.Sprintf("DIRECT %s", target)
+	state := pac.state()
+	key := cacheKey(state.keyMode, url, target)
+	now := time.Now()
+	entry, ok := state.cache.Get(key)
+	if ok && now.After(entry.expires) {
+		state.stats.expirations.Add(1)
 	}
-
-	entry, ok := pac.PacCache.Get(target)
-	if !ok {
-		vm := pac.Get().(*gopac.Parser)
-		defer pac.Put(vm)
-
-		pacrequest, err := vm.FindProxy(rawUrl, target)
-		if err != nil {
-			log.Printf("Failed to find proxy entry (%s)", err)
+	if ok && now.Before(entry.staleUntil) {
+		state.stats.hits.Add(1)
+		if now.After(entry.expires) {
+			// Answer with the stale entry, one evaluation refreshes it behind the scenes
+			state.flight.DoChan(key, func() (any, error) {
+				return evaluate(state, key, rawUrl, target), nil
+			})
 		}
-		entry = pacrequest
-
-		atomic.AddUint64(&cacheMisses, 1)
-		log.Printf("%s accessed for: %s\n", entry, target)
-		pac.PacCache.Add(target, entry)
-	} else {
-		atomic.AddUint64(&cacheHits, 1)
+		return entry.value
 	}
 
-	return entry
-}
-
-func startCacheStatsLogger() {
-	ticker := time.NewTicker(time.Minute)
-	go func() {
-		for range ticker.C {
-			hits := atomic.LoadUint64(&cacheHits)
-			misses := atomic.LoadUint64(&cacheMisses)
-			if hits != 0 {
-				log.Printf("Cache hits: %v, misses: %v | %v%% of cache hits\n", hits, misses, hits*100/(hits+misses))
-			}
-		}
-	}()
+	state.stats.misses.Add(1)
+	// Concurrent misses for the same host wait for a single evaluation
+	value, _, _ := state.flight.Do(key, func() (any, error) {
+		return evaluate(state, key, rawUrl, target), nil
+	})
+	return value.(string)
 }
 
-func CacheHits() uint64 {
-	return atomic.LoadUint64(&cacheHits)
-}
+// evaluate runs the PAC for target and caches the answer under key
+func evaluate(state cacheState, key, rawUrl, target string) string {
+	entry, err := findProxy(state.pool, state.evalTimeout, rawUrl, target)
+	if err != nil {
+		log.Printf("Failed to find proxy entry (%s), using %s", err, state.defaultRoute)
+		entry = state.defaultRoute
+	}
 
-func CacheMisses() uint64 {
-	return atomic.LoadUint64(&cacheMisses)
+	now := time.Now()
+	expires, staleUntil := now.Add(state.ttl), now.Add(2*state.ttl)
+	switch {
+	case err != nil:
+		// Never served stale, the next request past expires evaluates again
+		ttl := failedEvalTTL
+		if state.ttl > 0 {
+			ttl = min(ttl, state.ttl)
+		}
+		expires = now.Add(ttl)
+		staleUntil = expires
+	case state.ttl <= 0:
+		// Without a TTL entries only leave the cache when evicted
+		expires, staleUntil = now.AddDate(100, 0, 0), now.AddDate(100, 0, 0)
+	}
+	state.cache.Add(key, cacheEntry{value: entry, expires: expires, staleUntil: staleUntil})
+	state.stats.evaluations.Add(1)
+	log.Printf("%s accessed for: %s\n", entry, target)
+	return entry
 }
@@ -0,0 +1,91 @@
+package pac
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentMissesEvaluateOnce(t *testing.T) {
+	p, err := NewPac(`function FindProxyForURL(url, host) {
+		var end = new Date().getTime() + 200;
+		while (new Date().getTime() < end) {}
+		return "PROXY slow:3128";
+	}`, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := GetFromCache("https://cdn.example/", p); got != "PROXY slow:3128" {
+				t.Errorf("Expected every request to get the PAC answer, got %q", got)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := p.Stats().Evaluations; n != 1 {
+		t.Errorf("Expected one evaluation for 30 concurrent misses, got %d", n)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	switchAt := time.Now().Add(100 * time.Millisecond).UnixMilli()
+	p, err := NewPac(fmt.Sprintf(`function FindProxyForURL(url, host) {
+		return new Date().getTime() < %d ? "PROXY old:3128" : "PROXY new:3128";
+	}`, switchAt), 150*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := GetFromCache("https://cdn.example/", p); got != "PROXY old:3128" {
+		t.Fatalf("Expected the first answer, got %q", got)
+	}
+
+	// Expired but still fresh enough to be served while it refreshes
+	time.Sleep(200 * time.Millisecond)
+	if got := GetFromCache("https://cdn.example/", p); got != "PROXY old:3128" {
+		t.Errorf("Expected the stale answer right away, got %q", got)
+	}
+	for deadline := time.Now().Add(2 * time.Second); p.Stats().Evaluations < 2; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a background refresh")
+		}
+	}
+	if got := GetFromCache("https://cdn.example/", p); got != "PROXY new:3128" {
+		t.Errorf("Expected the refreshed answer, got %q", got)
+	}
+}
+
+func TestIPLiteralsUsePAC(t *testing.T) {
+	p, err := NewPac(`function FindProxyForURL(url, host) {
+		if (isInNet(host, "10.0.0.0", "255.0.0.0")) return "PROXY jump:3128";
+		if (host == "fd00::1") return "PROXY v6:3128";
+		return "DIRECT";
+	}`, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	tests := map[string]string{
+		"https://10.1.2.3:443":   "PROXY jump:3128",
+		"http://10.1.2.3/":       "PROXY jump:3128",
+		"https://192.168.0.1:22": "DIRECT",
+		"https://[fd00::1]:443":  "PROXY v6:3128",
+		"http://[fd00::1]/":      "PROXY v6:3128",
+	}
+	for rawUrl, want := range tests {
+		if got := GetFromCache(rawUrl, p); got != want {
+			t.Errorf("%s: expected %q, got %q", rawUrl, want, got)
+		}
+	}
+	if keys := p.state().cache.Keys(); len(keys) != 3 {
+		t.Errorf("Expected one cache entry per IP, got %v", keys)
+	}
+}
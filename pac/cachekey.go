@@ -0,0 +1,160 @@
+package pac
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// CacheKeyMode picks what PAC answers are cached by
+type CacheKeyMode string
+
+const (
+	CacheKeyAuto   CacheKeyMode = "auto"   // host unless the script looks at url, see detectCacheKeyMode
+	CacheKeyHost   CacheKeyMode = "host"   // one answer per host name
+	CacheKeyOrigin CacheKeyMode = "origin" // one answer per scheme, host and port
+	CacheKeyURL    CacheKeyMode = "url"    // one answer per full URL
+)
+
+// ParseCacheKeyMode validates a mode read from the configuration
+func ParseCacheKeyMode(mode string) (CacheKeyMode, error) {
+	switch m := CacheKeyMode(strings.ToLower(mode)); m {
+	case CacheKeyAuto, CacheKeyHost, CacheKeyOrigin, CacheKeyURL:
+		return m, nil
+	case "":
+		return CacheKeyAuto, nil
+	}
+	return "", fmt.Errorf("unknown PAC cache key mode %q, expected auto, host, origin or url", mode)
+}
+
+// cacheKey builds the cache key for u, host is u's host name
+func cacheKey(mode CacheKeyMode, u *url.URL, host string) string {
+	switch mode {
+	case CacheKeyOrigin:
+		port := u.Port()
+		if port == "" {
+			port = defaultPorts[u.Scheme]
+		}
+		return u.Scheme + "://" + net.JoinHostPort(host, port)
+	case CacheKeyURL:
+		return u.String()
+	}
+	return host
+}
+
+var defaultPorts = map[string]string{"http": "80", "https": "443", "ws": "80", "wss": "443", "ftp": "21"}
+
+var (
+	findProxyDecl = regexp.MustCompile(`FindProxyForURL\s*(?:=\s*function\s*)?\(\s*([\w$]+)`)
+
+	// Uses of url that only look at its scheme, url stands for the parameter
+	schemeChecks = []*regexp.Regexp{
+		regexp.MustCompile(`^\s*\.\s*(?:substring|substr|slice)\s*\(\s*0\s*,\s*[1-6]\s*\)`),
+		regexp.MustCompile(`^\s*\.\s*(?:startsWith|indexOf|lastIndexOf)\s*\(\s*["'][a-zA-Z]+:(?://)?["']\s*\)`),
+		regexp.MustCompile(`^\s*,\s*["'][a-zA-Z]+:(?://)?\*["']\s*\)`), // shExpMatch(url, "https:*")
+	}
+	shExpMatchCall = regexp.MustCompile(`shExpMatch\s*\(\s*$`)
+)
+
+// detectCacheKeyMode tells how much of the URL the script depends on: host
+// if FindProxyForURL never reads its url parameter, origin if it only checks
+// the scheme, url otherwise or when the script can't be understood.
+func detectCacheKeyMode(pacScript string) CacheKeyMode {
+	code := stripJSComments(pacScript)
+	decl := findProxyDecl.FindStringSubmatchIndex(code)
+	if decl == nil {
+		log.Println("Can't find FindProxyForURL's parameters, caching PAC answers per URL")
+		return CacheKeyURL
+	}
+	param := code[decl[2]:decl[3]]
+
+	mode := CacheKeyHost
+	for _, use := range identifierUses(code, param) {
+		if use == decl[2] {
+			continue // the declaration itself
+		}
+		rest := code[use+len(param):]
+		schemeOnly := false
+		for i, check := range schemeChecks {
+			if i == 2 && !shExpMatchCall.MatchString(code[:use]) {
+				continue
+			}
+			if check.MatchString(rest) {
+				schemeOnly = true
+				break
+			}
+		}
+		if !schemeOnly {
+			return CacheKeyURL
+		}
+		mode = CacheKeyOrigin
+	}
+	return mode
+}
+
+// stripJSComments blanks out comments, keeping offsets and string literals
+func stripJSComments(src string) string {
+	out := []byte(src)
+	for i := 0; i < len(out); i++ {
+		switch c := out[i]; {
+		case c == '"' || c == '\'' || c == '`':
+			for i++; i < len(out) && out[i] != c; i++ {
+				if out[i] == '\\' {
+					i++
+				}
+			}
+		case c == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case c == '/' && i+1 < len(out) && out[i+1] == '*':
+			end := strings.Index(string(out[i+2:]), "*/")
+			if end < 0 {
+				end = len(out) - i - 4
+			}
+			for j := i; j < i+end+4 && j < len(out); j++ {
+				if out[j] != '\n' {
+					out[j] = ' '
+				}
+			}
+			i += end + 3
+		}
+	}
+	return string(out)
+}
+
+// identifierUses returns the offsets where name appears as an identifier,
+// outside string literals and not as a property (obj.name)
+func identifierUses(code, name string) []int {
+	isIdent := func(c byte) bool {
+		return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}
+
+	var uses []int
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		if c == '"' || c == '\'' || c == '`' {
+			for i++; i < len(code) && code[i] != c; i++ {
+				if code[i] == '\\' {
+					i++
+				}
+			}
+			continue
+		}
+		if !strings.HasPrefix(code[i:], name) || i > 0 && isIdent(code[i-1]) {
+			continue
+		}
+		end := i + len(name)
+		if end < len(code) && isIdent(code[end]) {
+			continue
+		}
+		if prev := strings.TrimRight(code[:i], " \t\r\n"); strings.HasSuffix(prev, ".") {
+			continue
+		}
+		uses = append(uses, i)
+	}
+	return uses
+}
@@ -0,0 +1,58 @@
+package pac
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDetectCacheKeyMode(t *testing.T) {
+	tests := map[string]CacheKeyMode{
+		`function FindProxyForURL(url, host) { return "DIRECT"; }`: CacheKeyHost,
+		`function FindProxyForURL(url, host) { // url is unused
+			return "DIRECT"; /* url */ }`: CacheKeyHost,
+		`function FindProxyForURL(url, host) { if (obj.url) return "url"; return "DIRECT"; }`:               CacheKeyHost,
+		`function FindProxyForURL(url, host) { if (url.substring(0, 5) == "http:") return "PROXY a:1"; }`:   CacheKeyOrigin,
+		`function FindProxyForURL(u, h) { if (shExpMatch(u, "https:*")) return "PROXY a:1"; }`:              CacheKeyOrigin,
+		`var FindProxyForURL = function(url, host) { if (url.startsWith("ftp:")) return "PROXY a:1"; }`:     CacheKeyOrigin,
+		`function FindProxyForURL(url, host) { if (shExpMatch(url, "*/downloads/*")) return "PROXY a:1"; }`: CacheKeyURL,
+		`function FindProxyForURL(url, host) { return pick(url); }`:                                         CacheKeyURL,
+		`this["FindProxy" + "ForURL"] = function() {}`:                                                      CacheKeyURL,
+	}
+	for script, want := range tests {
+		if got := detectCacheKeyMode(script); got != want {
+			t.Errorf("Expected %s for %s, got %s", want, script, got)
+		}
+	}
+}
+
+func TestCacheKeyModes(t *testing.T) {
+	p, err := NewPac(`function FindProxyForURL(url, host) {
+		if (url.substring(0, 6) == "https:") return "PROXY tls:3128";
+		return "PROXY plain:3128";
+	}`, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	if got := GetFromCache("http://example.com/", p); got != "PROXY plain:3128" {
+		t.Errorf("Expected the http answer, got %q", got)
+	}
+	if got := GetFromCache("https://example.com:443", p); got != "PROXY tls:3128" {
+		t.Errorf("Expected auto mode to keep schemes apart, got %q", got)
+	}
+
+	// Forcing host keys makes the first answer stick for both schemes
+	p.SetCacheKeyMode(CacheKeyHost)
+	GetFromCache("http://example.com/", p)
+	if got := GetFromCache("https://example.com:443", p); got != "PROXY plain:3128" {
+		t.Errorf("Expected host mode to share one entry, got %q", got)
+	}
+
+	p.SetCacheKeyMode(CacheKeyURL)
+	GetFromCache("http://example.com/a", p)
+	GetFromCache("http://example.com/b", p)
+	if keys := p.state().cache.Keys(); len(keys) != 2 {
+		t.Errorf("Expected one entry per URL, got %v", keys)
+	}
+}
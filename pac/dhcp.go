@@ -0,0 +1,135 @@
+package pac
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	dhcpBootRequest = 1
+	dhcpBootReply   = 2
+	dhcpInform      = 8
+	dhcpOptionType  = 53
+	dhcpOptionList  = 55
+	dhcpOptionWPAD  = 252
+	dhcpOptionEnd   = 255
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+// dhcpWPAD asks the DHCP server for option 252 with a DHCPINFORM, which
+// doesn't touch the lease. Listening on port 68 usually needs privileges.
+func (d *wpadDiscovery) dhcpWPAD(ctx context.Context) (string, error) {
+	server, err := net.ResolveUDPAddr("udp4", d.dhcpServer)
+	if err != nil {
+		return "", err
+	}
+
+	// The address the kernel would send from tells which interface we're on
+	probe, err := net.DialUDP("udp4", nil, server)
+	if err != nil {
+		return "", err
+	}
+	localIP := probe.LocalAddr().(*net.UDPAddr).IP
+	probe.Close()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: localIP, Port: d.dhcpClientPort})
+	if err != nil {
+		return "", fmt.Errorf("failed to listen for DHCP answers: %w", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	xid := rand.Uint32()
+	if _, err := conn.WriteToUDP(dhcpInformPacket(xid, localIP, hardwareAddr(localIP)), server); err != nil {
+		return "", fmt.Errorf("failed to send DHCPINFORM: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return "", fmt.Errorf("no DHCP answer: %w", err)
+		}
+		pacURL, ok, err := parseDHCPWPAD(buf[:n], xid)
+		if !ok {
+			continue // someone else's answer
+		}
+		return pacURL, err
+	}
+}
+
+// hardwareAddr returns the MAC of the interface holding ip, nil if unknown
+func hardwareAddr(ip net.IP) net.HardwareAddr {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return iface.HardwareAddr
+			}
+		}
+	}
+	return nil
+}
+
+func dhcpInformPacket(xid uint32, ciaddr net.IP, chaddr net.HardwareAddr) []byte {
+	pkt := make([]byte, 240)
+	pkt[0] = dhcpBootRequest
+	pkt[1] = 1 // ethernet
+	pkt[2] = 6 // hardware address length
+	binary.BigEndian.PutUint32(pkt[4:8], xid)
+	copy(pkt[12:16], ciaddr.To4())
+	copy(pkt[28:44], chaddr)
+	copy(pkt[236:240], dhcpMagicCookie)
+	return append(pkt,
+		dhcpOptionType, 1, dhcpInform,
+		dhcpOptionList, 1, dhcpOptionWPAD,
+		dhcpOptionEnd,
+	)
+}
+
+// parseDHCPWPAD reads option 252 from a DHCP answer. ok is false if the
+// packet isn't an answer to xid.
+func parseDHCPWPAD(pkt []byte, xid uint32) (pacURL string, ok bool, err error) {
+	if len(pkt) < 240 || pkt[0] != dhcpBootReply || binary.BigEndian.Uint32(pkt[4:8]) != xid || !bytes.Equal(pkt[236:240], dhcpMagicCookie) {
+		return "", false, nil
+	}
+
+	options := pkt[240:]
+	for len(options) > 0 {
+		code := options[0]
+		if code == dhcpOptionEnd {
+			break
+		}
+		if code == 0 { // padding
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || len(options) < 2+int(options[1]) {
+			return "", true, errors.New("truncated DHCP option")
+		}
+		value := options[2 : 2+int(options[1])]
+		if code == dhcpOptionWPAD {
+			// Some servers count the trailing NUL in the option
+			return strings.TrimRight(string(value), "\x00"), true, nil
+		}
+		options = options[2+int(options[1]):]
+	}
+	return "", true, errors.New("DHCP server has no WPAD option")
+}
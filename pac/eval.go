@@ -0,0 +1,104 @@
+package pac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/LucasSnatiago/GoProxy/pac/internal/gopac"
+)
+
+// DefaultEvalTimeout bounds a single FindProxyForURL call
+const DefaultEvalTimeout = 2 * time.Second
+
+// DefaultMaxScriptSize is the largest PAC script accepted unless
+// SetMaxScriptSize says otherwise
+const DefaultMaxScriptSize = 2 << 20
+
+var errEvalTimeout = errors.New("PAC evaluation timed out")
+
+// newParser compiles the script, alert() messages go to the log. Its
+// top-level code gets the same timeout as an evaluation, 0 disables it.
+func newParser(pacScript string, timeout time.Duration) (*gopac.Parser, error) {
+	parser := new(gopac.Parser)
+	if err := parser.SetAlert(logAlert); err != nil {
+		return nil, fmt.Errorf("failed to load PAC script: %w", err)
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := parser.ParseBytesContext(ctx, []byte(pacScript))
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = errEvalTimeout
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load PAC script: %w", err)
+	}
+	return parser, nil
+}
+
+func logAlert(msg string) {
+	log.Println("PAC alert:", msg)
+}
+
+// checkScriptSize rejects scripts over limit bytes
+func checkScriptSize(pacScript string, limit int64) error {
+	if int64(len(pacScript)) > limit {
+		return fmt.Errorf("PAC script is %d bytes, over the %d bytes limit", len(pacScript), limit)
+	}
+	return nil
+}
+
+type evalResult struct {
+	entry string
+	err   error
+}
+
+// findProxy runs FindProxyForURL on a pooled VM. A VM that timed out is
+// dropped from the pool.
+func findProxy(vmPool *sync.Pool, timeout time.Duration, rawUrl, host string) (string, error) {
+	parser, ok := vmPool.Get().(*gopac.Parser)
+	if !ok {
+		return "", errors.New("no PAC VM available")
+	}
+
+	entry, err := runFindProxy(parser, timeout, rawUrl, host)
+	if !errors.Is(err, errEvalTimeout) {
+		vmPool.Put(parser)
+	}
+	return entry, err
+}
+
+// runFindProxy runs FindProxyForURL on parser. Past timeout the caller gets
+// errEvalTimeout right away while the VM is interrupted in the background.
+func runFindProxy(parser *gopac.Parser, timeout time.Duration, rawUrl, host string) (string, error) {
+	if timeout <= 0 {
+		return parser.FindProxy(rawUrl, host)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan evalResult, 1)
+	go func() {
+		entry, err := parser.FindProxyContext(ctx, rawUrl, host)
+		done <- evalResult{entry, err}
+	}()
+
+	// A host function like dnsResolve may hold the VM past the timeout
+	select {
+	case result := <-done:
+		if errors.Is(result.err, context.DeadlineExceeded) {
+			return "", errEvalTimeout
+		}
+		return result.entry, result.err
+	case <-ctx.Done():
+		return "", errEvalTimeout
+	}
+}
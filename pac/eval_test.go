@@ -0,0 +1,114 @@
+package pac
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvalTimeout(t *testing.T) {
+	// The inner try/catch swallows single interrupts
+	p, err := NewPac(`function FindProxyForURL(url, host) {
+		if (host == "fast.example") return "PROXY fast:3128";
+		while (true) { try { while (true) {} } catch (e) {} }
+	}`, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetEvalLimits(50*time.Millisecond, "PROXY fallback:3128")
+
+	start := time.Now()
+	if got := GetFromCache("http://loop.example/", p); got != "PROXY fallback:3128" {
+		t.Errorf("Expected the default route on timeout, got %q", got)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the caller to be released at the timeout, took %v", elapsed)
+	}
+
+	// Later evaluations get a fresh VM
+	if got := GetFromCache("http://fast.example/", p); got != "PROXY fast:3128" {
+		t.Errorf("Expected the PAC to keep working after a timeout, got %q", got)
+	}
+}
+
+func TestEndlessTopLevelCode(t *testing.T) {
+	const endless = `while (true) {} function FindProxyForURL(url, host) { return "DIRECT"; }`
+	start := time.Now()
+	if _, err := NewPac(endless, time.Minute); !errors.Is(err, errEvalTimeout) {
+		t.Errorf("Expected a script that never finishes loading to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > DefaultEvalTimeout+time.Second {
+		t.Errorf("Expected loading to stop at the timeout, took %v", elapsed)
+	}
+
+	p, err := NewPac(`function FindProxyForURL(url, host) { return "PROXY good:3128"; }`, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetEvalLimits(50*time.Millisecond, "")
+	if err := p.Update(endless, time.Minute); !errors.Is(err, errEvalTimeout) {
+		t.Errorf("Expected the update to time out, got %v", err)
+	}
+	if got := GetFromCache("http://example.com/", p); got != "PROXY good:3128" {
+		t.Errorf("Expected the last good script to keep serving, got %q", got)
+	}
+}
+
+func TestFailedEvaluationsExpireSoon(t *testing.T) {
+	failedEvalTTL = 50 * time.Millisecond
+	t.Cleanup(func() { failedEvalTTL = 5 * time.Second })
+
+	recoverAt := time.Now().Add(20 * time.Millisecond).UnixMilli()
+	p, err := NewPac(fmt.Sprintf(`function FindProxyForURL(url, host) {
+		if (new Date().getTime() < %d) throw "not ready";
+		return "PROXY up:3128";
+	}`, recoverAt), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetEvalLimits(time.Second, "PROXY fallback:3128")
+
+	if got := GetFromCache("http://example.com/", p); got != "PROXY fallback:3128" {
+		t.Fatalf("Expected the default route while the PAC fails, got %q", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := GetFromCache("http://example.com/", p); got != "PROXY up:3128" {
+		t.Errorf("Expected the failure to expire instead of lasting the TTL, got %q", got)
+	}
+}
+
+func TestMaxScriptSize(t *testing.T) {
+	script := `function FindProxyForURL(url, host) { return "DIRECT"; }` + strings.Repeat(" ", 64)
+	small, err := NewPac(`function FindProxyForURL(url, host) { return "PROXY small:3128"; }`, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small.SetMaxScriptSize(64)
+	if err := small.Update(script, time.Minute); err == nil {
+		t.Errorf("Expected a script over the limit to be rejected")
+	}
+
+	// The limit belongs to the instance
+	other, err := NewPac(`function FindProxyForURL(url, host) { return "PROXY other:3128"; }`, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Update(script, time.Minute); err != nil {
+		t.Errorf("Expected another PAC to keep the default limit, got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := os.WriteFile(path, []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := small.Load(path, time.Minute); err == nil {
+		t.Errorf("Expected a file over the limit to be refused")
+	}
+	if got := GetFromCache("http://example.com/", small); got != "PROXY small:3128" {
+		t.Errorf("Expected the old script to keep serving, got %q", got)
+	}
+}
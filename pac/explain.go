@@ -0,0 +1,152 @@
+package pac
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LucasSnatiago/GoProxy/pac/internal/gopac"
+)
+
+// Explanation tells how the PAC routes a URL and why
+type Explanation struct {
+	URL          string        `json:"url"`
+	Host         string        `json:"host"`
+	CacheKey     string        `json:"cache_key"`
+	CacheKeyMode CacheKeyMode  `json:"cache_key_mode"`
+	Result       string        `json:"result"`        // the answer GoProxy uses right now
+	Cached       bool          `json:"cached"`        // Result came from the cache
+	Stale        bool          `json:"stale"`         // the cached answer is past its TTL and being refreshed
+	Evaluated    string        `json:"evaluated"`     // what a fresh FindProxyForURL call returns
+	EvalTime     time.Duration `json:"eval_time"`     // how long that call took
+	EvalError    string        `json:"eval_error"`    // why it failed, Evaluated is the default route then
+	Candidates   []string      `json:"candidates"`    // Result parsed, in the order they're tried
+	ParseError   string        `json:"parse_error"`   // why Result has no usable candidate
+	Alerts       []string      `json:"alerts"`        // alert() calls made by the fresh evaluation
+	Offline      bool          `json:"offline"`       // the PAC in use is a saved copy or the DIRECT fallback
+	Source       string        `json:"source"`        // where the PAC comes from
+	WPADLocation string        `json:"wpad_location"` // the PAC WPAD discovery picked
+}
+
+// Explain runs the current script for rawUrl on a pooled VM, next to what the
+// cache holds, without touching the cache or its statistics. A bare host name
+// is taken as http://host/.
+func Explain(rawUrl string, p *Pac) (*Explanation, error) {
+	if !strings.Contains(rawUrl, "://") {
+		rawUrl = "http://" + rawUrl
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return nil, errors.New("url has no host")
+	}
+
+	state := p.state()
+	p.RLock()
+	source, offline := p.source, p.offline
+	p.RUnlock()
+
+	ex := &Explanation{
+		URL:          rawUrl,
+		Host:         host,
+		CacheKey:     cacheKey(state.keyMode, u, host),
+		CacheKeyMode: state.keyMode,
+		Offline:      offline,
+		Source:       source.url,
+		WPADLocation: source.wpadURL,
+	}
+	if entry, ok := state.cache.Peek(ex.CacheKey); ok && time.Now().Before(entry.staleUntil) {
+		ex.Cached = true
+		ex.Stale = time.Now().After(entry.expires)
+		ex.Result = entry.value
+	}
+
+	parser, ok := state.pool.Get().(*gopac.Parser)
+	if !ok {
+		return nil, errors.New("no PAC VM available")
+	}
+	// The VM may still be running after a timeout, guard the alerts
+	var mu sync.Mutex
+	var alerts []string
+	parser.SetAlert(func(msg string) {
+		mu.Lock()
+		alerts = append(alerts, msg)
+		mu.Unlock()
+	})
+	start := time.Now()
+	ex.Evaluated, err = runFindProxy(parser, state.evalTimeout, rawUrl, host)
+	ex.EvalTime = time.Since(start)
+	if !errors.Is(err, errEvalTimeout) {
+		parser.SetAlert(logAlert)
+		state.pool.Put(parser)
+	}
+	if err != nil {
+		ex.EvalError = err.Error()
+		ex.Evaluated = state.defaultRoute
+	}
+	mu.Lock()
+	ex.Alerts = append([]string(nil), alerts...)
+	mu.Unlock()
+
+	if !ex.Cached {
+		ex.Result = ex.Evaluated
+	}
+	candidates, err := ParseProxyList(ex.Result)
+	if err != nil {
+		ex.ParseError = err.Error()
+	}
+	for _, candidate := range candidates {
+		ex.Candidates = append(ex.Candidates, ProxyName(candidate))
+	}
+	return ex, nil
+}
+
+func (ex *Explanation) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "URL:        %s\n", ex.URL)
+	fmt.Fprintf(&b, "Host:       %s\n", ex.Host)
+	fmt.Fprintf(&b, "PAC source: %s", ex.Source)
+	if ex.WPADLocation != "" {
+		fmt.Fprintf(&b, " (%s)", ex.WPADLocation)
+	}
+	if ex.Offline {
+		b.WriteString(" [offline, using a saved copy or DIRECT]")
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(&b, "Cache key:  %s (%s)\n", ex.CacheKey, ex.CacheKeyMode)
+
+	switch {
+	case ex.Stale:
+		fmt.Fprintf(&b, "Result:     %s (from the cache, stale and refreshing)\n", ex.Result)
+	case ex.Cached:
+		fmt.Fprintf(&b, "Result:     %s (from the cache)\n", ex.Result)
+	default:
+		fmt.Fprintf(&b, "Result:     %s (not cached)\n", ex.Result)
+	}
+	fmt.Fprintf(&b, "Evaluated:  %s in %v\n", ex.Evaluated, ex.EvalTime)
+	if ex.EvalError != "" {
+		fmt.Fprintf(&b, "Eval error: %s, the default route was used\n", ex.EvalError)
+	}
+
+	b.WriteString("Candidates:\n")
+	for i, candidate := range ex.Candidates {
+		fmt.Fprintf(&b, "  %d. %s\n", i+1, candidate)
+	}
+	if ex.ParseError != "" {
+		fmt.Fprintf(&b, "  %s\n", ex.ParseError)
+	}
+
+	if len(ex.Alerts) > 0 {
+		b.WriteString("Alerts:\n")
+		for _, alert := range ex.Alerts {
+			fmt.Fprintf(&b, "  %s\n", alert)
+		}
+	}
+	return b.String()
+}
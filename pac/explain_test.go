@@ -0,0 +1,64 @@
+package pac
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExplain(t *testing.T) {
+	p, err := NewPac(`function FindProxyForURL(url, host) {
+		alert("routing " + host);
+		return "PROXY jump:3128; DIRECT";
+	}`, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	ex, err := Explain("example.com", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.URL != "http://example.com" || ex.Host != "example.com" {
+		t.Errorf("Expected the bare host as an http URL, got %q (%q)", ex.URL, ex.Host)
+	}
+	if ex.Cached || ex.Result != "PROXY jump:3128; DIRECT" || ex.Evaluated != ex.Result {
+		t.Errorf("Expected a fresh evaluation, got %+v", ex)
+	}
+	if !slices.Equal(ex.Candidates, []string{"http://jump:3128", "DIRECT"}) {
+		t.Errorf("Unexpected candidates %v", ex.Candidates)
+	}
+	if !slices.Equal(ex.Alerts, []string{"routing example.com"}) {
+		t.Errorf("Unexpected alerts %v", ex.Alerts)
+	}
+	if p.Stats() != (CacheStats{}) {
+		t.Errorf("Explain must not touch the cache statistics, got %+v", p.Stats())
+	}
+
+	GetFromCache("http://example.com/", p)
+	ex, err = Explain("http://example.com/", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ex.Cached || ex.Stale {
+		t.Errorf("Expected the answer to come from the cache, got %+v", ex)
+	}
+}
+
+func TestExplainEvalError(t *testing.T) {
+	p, err := NewPac(`function FindProxyForURL(url, host) { throw "broken"; }`, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	p.SetEvalLimits(time.Second, "PROXY fallback:8080")
+
+	ex, err := Explain("http://example.com/", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.EvalError == "" || ex.Result != "PROXY fallback:8080" {
+		t.Errorf("Expected the default route after an error, got %+v", ex)
+	}
+}
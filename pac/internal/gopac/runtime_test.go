@@ -0,0 +1,124 @@
+// Copyright 2014 Jack Wakefield
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gopac
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRuntimeFunctions(t *testing.T) {
+	rt, err := newRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		call   string
+		params []any
+		want   string
+	}{
+		{"isPlainHostName", []any{"www"}, "true"},
+		{"isPlainHostName", []any{"www.netscape.com"}, "false"},
+		{"dnsDomainIs", []any{"www.netscape.com", ".netscape.com"}, "true"},
+		{"dnsDomainIs", []any{"www", ".netscape.com"}, "false"},
+		{"dnsDomainIs", []any{"w.mcom.com", ".netscape.com"}, "false"},
+		{"localHostOrDomainIs", []any{"www.netscape.com", "www.netscape.com"}, "true"},
+		{"localHostOrDomainIs", []any{"www", "www.netscape.com"}, "true"},
+		{"localHostOrDomainIs", []any{"www.mcom.com", "wwww.netscape.com"}, "false"},
+		{"localHostOrDomainIs", []any{"home.netscape.com", "wwww.netscape.com"}, "false"},
+		{"isInNet", []any{"localhost", "127.0.0.1", "255.255.255.255"}, "true"},
+		{"isInNet", []any{"localhost", "127.0.0.0", "255.0.0.0"}, "true"},
+		{"isInNet", []any{"localhost", "127.0.0.0", "255.0.0.255"}, "false"},
+		{"dnsResolve", []any{"localhost"}, "127.0.0.1"},
+		{"dnsDomainLevels", []any{"www"}, "0"},
+		{"dnsDomainLevels", []any{"www.netscape.com"}, "2"},
+		{"shExpMatch", []any{"http://home.netscape.com/people/ari/index.html", "*/ari/*"}, "true"},
+		{"shExpMatch", []any{"http://home.netscape.com/people/montulli/index.html", "*/ari/*"}, "false"},
+	}
+	for _, test := range tests {
+		value, err := rt.vm.Call(test.call, nil, test.params...)
+		if err != nil {
+			t.Errorf("%s%v: %v", test.call, test.params, err)
+			continue
+		}
+		if got := value.String(); got != test.want {
+			t.Errorf("%s%v: expected %s, got %s", test.call, test.params, test.want, got)
+		}
+	}
+}
+
+func TestRuntimeFindProxyContext(t *testing.T) {
+	rt, err := newRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rt.run(`function FindProxyForURL(url, host) {
+		if (host == "loop") { while (true) { try { for (;;) {} } catch (e) {} } }
+		return "DIRECT";
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := rt.findProxyForURLContext(ctx, "http://loop/", "loop"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected an endless script to stop with the context, got %v", err)
+	}
+
+	proxy, err := rt.findProxyForURLContext(context.Background(), "http://example.com/", "example.com")
+	if err != nil || proxy != "DIRECT" {
+		t.Errorf("Expected DIRECT, got %q %v", proxy, err)
+	}
+}
+
+func TestRuntimeRunContext(t *testing.T) {
+	rt, err := newRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := rt.runContext(ctx, `while (true) {}`); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected endless top-level code to stop with the context, got %v", err)
+	}
+	if err := rt.runContext(context.Background(), `var loaded = true;`); err != nil {
+		t.Errorf("Expected the script to load, got %v", err)
+	}
+}
+
+func TestRuntimeAlert(t *testing.T) {
+	rt, err := newRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.vm.Run(`alert("discarded")`); err != nil {
+		t.Errorf("Expected alert to exist without a receiver, got %v", err)
+	}
+
+	var messages []string
+	rt.setAlert(func(message string) { messages = append(messages, message) })
+	if _, err := rt.vm.Run(`alert("hello " + 42)`); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(messages, []string{"hello 42"}) {
+		t.Errorf("Unexpected alerts %v", messages)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2014 Jack Wakefield
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gopac
+
+import "testing"
+
+func TestUtils(t *testing.T) {
+	tests := []struct {
+		name string
+		got  bool
+		want bool
+	}{
+		{"isPlainHostName www", isPlainHostName("www"), true},
+		{"isPlainHostName www.netscape.com", isPlainHostName("www.netscape.com"), false},
+		{"dnsDomainIs www.netscape.com", dnsDomainIs("www.netscape.com", ".netscape.com"), true},
+		{"dnsDomainIs www", dnsDomainIs("www", ".netscape.com"), false},
+		{"dnsDomainIs www.mcom.com", dnsDomainIs("www.mcom.com", ".netscape.com"), false},
+		{"localHostOrDomainIs equal", localHostOrDomainIs("www.netscape.com", "www.netscape.com"), true},
+		{"localHostOrDomainIs plain", localHostOrDomainIs("www", "www.netscape.com"), true},
+		{"localHostOrDomainIs other domain", localHostOrDomainIs("www.mcom.com", "wwww.netscape.com"), false},
+		{"localHostOrDomainIs other host", localHostOrDomainIs("home.netscape.com", "wwww.netscape.com"), false},
+		{"isInNet /32", isInNet("localhost", "127.0.0.1", "255.255.255.255"), true},
+		{"isInNet /8", isInNet("localhost", "127.0.0.0", "255.0.0.0"), true},
+		{"isInNet odd mask", isInNet("localhost", "127.0.0.0", "255.0.0.255"), false},
+		{"shExpMatch ari", shExpMatch("http://home.netscape.com/people/ari/index.html", "*/ari/*"), true},
+		{"shExpMatch montulli", shExpMatch("http://home.netscape.com/people/montulli/index.html", "*/ari/*"), false},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, test.got)
+		}
+	}
+
+	if ip := dnsResolve("localhost"); ip != "127.0.0.1" {
+		t.Errorf("Expected localhost to resolve to 127.0.0.1, got %q", ip)
+	}
+	if levels := dnsDomainLevels("www"); levels != 0 {
+		t.Errorf("Expected 0 domain levels in www, got %d", levels)
+	}
+	if levels := dnsDomainLevels("www.netscape.com"); levels != 2 {
+		t.Errorf("Expected 2 domain levels in www.netscape.com, got %d", levels)
+	}
+}
@@ -0,0 +1,96 @@
+package pac
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/LucasSnatiago/GoProxy/internal/cachefile"
+)
+
+// Used when the PAC can't be downloaded and no copy was saved, so GoProxy
+// still starts off the corporate network
+const directOnlyPAC = `function FindProxyForURL(url, host) { return "DIRECT"; }`
+
+// How often an unreachable PAC source is tried again
+var pacRetryInterval = 30 * time.Second
+
+// lastGoodPath is where the last PAC downloaded from pacURL is kept
+func lastGoodPath(cacheDir, pacURL string) string {
+	return cachefile.Path(cacheDir, "", pacURL, ".pac")
+}
+
+// saveLastGood keeps the script used when pacURL can't be downloaded
+func saveLastGood(cacheDir, pacURL, pacScript string) error {
+	if cacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create PAC cache directory: %w", err)
+	}
+	return cachefile.WriteAtomic(lastGoodPath(cacheDir, pacURL), []byte(pacScript))
+}
+
+func loadLastGood(cacheDir, pacURL string) (string, error) {
+	if cacheDir == "" {
+		return "", os.ErrNotExist
+	}
+	data, err := os.ReadFile(lastGoodPath(cacheDir, pacURL))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// SetCacheDir changes where the last downloaded PAC is kept, "" disables it
+func (pac *Pac) SetCacheDir(cacheDir string) {
+	pac.Lock()
+	defer pac.Unlock()
+	pac.cacheDir = cacheDir
+}
+
+// Offline reports whether the PAC in use isn't the one from the source,
+// either a saved copy or the DIRECT-only fallback
+func (pac *Pac) Offline() bool {
+	pac.RLock()
+	defer pac.RUnlock()
+	return pac.offline
+}
+
+// retryDownload tries source again until it answers, then swaps in the real
+// PAC. It gives up when the PAC is closed or a script newer than generation
+// was swapped in, so it never undoes a reload.
+func (pac *Pac) retryDownload(source pacSource, ttl time.Duration, generation uint64) {
+	retry := time.NewTicker(pacRetryInterval)
+	defer retry.Stop()
+	for {
+		select {
+		case <-pac.closed:
+			return
+		case <-retry.C:
+		}
+
+		pac.RLock()
+		current := pac.generation
+		pac.RUnlock()
+		if current != generation {
+			return // a reload got there first
+		}
+
+		download, err := downloadPAC(source, pac.scriptLimit())
+		if err != nil {
+			log.Println("PAC still unreachable:", err)
+			continue
+		}
+		installed, err := pac.install(download, ttl, &generation)
+		if err != nil {
+			log.Println("Downloaded PAC doesn't compile:", err)
+			continue
+		}
+		if installed {
+			log.Println("PAC source is reachable again, switched to", source.url)
+		}
+		return
+	}
+}
@@ -0,0 +1,13 @@
+package pac
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Set once, retry goroutines of earlier tests keep reading it
+	pacRetryInterval = 10 * time.Millisecond
+	os.Exit(m.Run())
+}
@@ -1,101 +1,257 @@
 package pac
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
 	"sort"
 	"sync"
 	"time"
 
-	"github.com/LucasSnatiago/gopac"
-	"github.com/hashicorp/golang-lru/v2/expirable"
+	lru "github.com/hashicorp/golang-lru/v2"
 	"golang.org/x/net/proxy"
+	"golang.org/x/sync/singleflight"
 )
 
 type Pac struct {
-	PacCache      *expirable.LRU[string, string] // Cache for PAC entries
-	Auth          *proxy.Auth                    // Optional authentication for the PAC script
+	PacCache      *lru.Cache[string, cacheEntry] // Cache for PAC entries
+	flight        *singleflight.Group            // Collapses concurrent evaluations of the same host
+	Auth          *proxy.Auth                    // Optional credentials for the upstream proxies
 	pacScript     string                         // The PAC script content
 	ttlDuration   time.Duration                  // Duration for which the PAC entries are cached
-	*sync.RWMutex                                // Mutex to protect access to the pool
-	*sync.Pool                                   // Pool of gopac.Parser instances
+	source        pacSource                      // Where the script was downloaded from
+	generation    uint64                         // Bumped every time the script is swapped
+	stopRefresh   context.CancelFunc             // Stops the background refresh, nil if not running
+	cacheDir      string                         // Where the last downloaded PAC is saved, "" disables it
+	offline       bool                           // Serving a saved copy or DIRECT until the source answers
+	evalTimeout   time.Duration                  // Longest a FindProxyForURL call or a script load may run, 0 disables
+	maxScriptSize int64                          // Largest script downloaded or compiled, in bytes
+	defaultRoute  string                         // Used when the PAC fails or times out
+	stats         *cacheCounters                 // Cache statistics of this instance
+	cacheKeyMode  CacheKeyMode                   // What answers are cached by, as configured
+	keyMode       CacheKeyMode                   // cacheKeyMode with auto resolved for the current script
+	closed        chan struct{}                  // Closed by Close to stop background work
+	closeOnce     sync.Once
+	*sync.RWMutex // Protects the fields swapped by Update and SetAuth
+	*sync.Pool    // Pool of gopac.Parser instances
 }
 
 func NewPac(pacScript string, ttl time.Duration) (*Pac, error) {
-	vmPool := sync.Pool{
-		New: func() any {
-			vm := new(gopac.Parser)
-			if err := vm.ParseBytes([]byte(pacScript)); err != nil {
-				return fmt.Errorf("failed to load PAC script: %v", err)
-			}
-			return vm
-		},
+	return newPac(pacScript, ttl, DefaultMaxScriptSize)
+}
+
+func newPac(pacScript string, ttl time.Duration, maxScriptSize int64) (*Pac, error) {
+	if err := checkScriptSize(pacScript, maxScriptSize); err != nil {
+		return nil, err
+	}
+	vmPool, err := newVMPool(pacScript, DefaultEvalTimeout)
+	if err != nil {
+		return nil, err
 	}
 
-	// Start metrics for cache hits and misses
-	cacheHits = 0
-	cacheMisses = 0
-	startCacheStatsLogger()
+	stats := &cacheCounters{}
 	return &Pac{
-		PacCache:    expirable.NewLRU[string, string](1000, nil, ttl), // Caching a thousand most recent visited sites
-		Auth:        nil,                                              // No authentication by default
-		pacScript:   pacScript,
-		ttlDuration: ttl,
-		Pool:        &vmPool,
+		PacCache:      newPacCache(stats),
+		stats:         stats,
+		closed:        make(chan struct{}),
+		flight:        &singleflight.Group{},
+		Auth:          nil, // No authentication by default
+		pacScript:     pacScript,
+		ttlDuration:   ttl,
+		evalTimeout:   DefaultEvalTimeout,
+		maxScriptSize: maxScriptSize,
+		cacheKeyMode:  CacheKeyAuto,
+		keyMode:       detectCacheKeyMode(pacScript),
+		defaultRoute:  "DIRECT",
+		RWMutex:       &sync.RWMutex{},
+		Pool:          vmPool,
 	}, nil
 }
 
-func (pac *Pac) Reload() error {
-	newPac, err := NewPac(pac.pacScript, pac.ttlDuration)
+// newVMPool compiles the script once up front so a broken or endless PAC is
+// reported instead of surfacing later from the pool
+func newVMPool(pacScript string, timeout time.Duration) (*sync.Pool, error) {
+	first, err := newParser(pacScript, timeout)
 	if err != nil {
-		return fmt.Errorf("failed to reload PAC: %v", err)
+		return nil, err
 	}
 
-	pac.PacCache = newPac.PacCache
-	pac.Auth = newPac.Auth
-	pac.ttlDuration = newPac.ttlDuration
-	pac.Pool = newPac.Pool
-	return nil
+	vmPool := &sync.Pool{
+		New: func() any {
+			vm, err := newParser(pacScript, timeout)
+			if err != nil {
+				return err
+			}
+			return vm
+		},
+	}
+	vmPool.Put(first)
+	return vmPool, nil
 }
 
-func DownloadPAC(pacURL string) (string, error) {
-	client := &http.Client{
-		Timeout: time.Second * 300,
-	}
+// Update swaps in a new PAC script and cache TTL. The old script keeps
+// serving if the new one doesn't compile.
+func (pac *Pac) Update(pacScript string, ttl time.Duration) error {
+	_, err := pac.swap(pacScript, ttl, nil, nil)
+	return err
+}
 
-	resp, err := client.Get(pacURL)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to download pac from %s: %w", pacURL, err)
+// swap compiles pacScript and installs it, together with source when not nil.
+// With a generation, nothing changes if the script was swapped since that
+// generation was read, and swap reports false.
+func (pac *Pac) swap(pacScript string, ttl time.Duration, source *pacSource, generation *uint64) (bool, error) {
+	pac.RLock()
+	limit, timeout := pac.maxScriptSize, pac.evalTimeout
+	pac.RUnlock()
+	if err := checkScriptSize(pacScript, limit); err != nil {
+		return false, err
 	}
-	defer resp.Body.Close()
-
-	data, err := io.ReadAll(resp.Body)
+	vmPool, err := newVMPool(pacScript, timeout)
 	if err != nil {
-		return "", fmt.Errorf("failed to read answer from PAC: %w", err)
+		return false, err
 	}
 
-	return string(data), nil
+	pac.Lock()
+	defer pac.Unlock()
+	if generation != nil && *generation != pac.generation {
+		return false, nil
+	}
+	pac.generation++
+	if pac.cacheKeyMode == CacheKeyAuto {
+		pac.keyMode = detectCacheKeyMode(pacScript)
+	}
+	pac.PacCache = newPacCache(pac.stats)
+	pac.flight = &singleflight.Group{}
+	pac.pacScript = pacScript
+	pac.ttlDuration = ttl
+	pac.Pool = vmPool
+	if source != nil {
+		pac.source = *source
+		pac.offline = false
+	}
+	return true, nil
+}
+
+// Reload downloads the PAC again from its source, or rebuilds it from the
+// current script if it didn't come from a URL
+func (pac *Pac) Reload() error {
+	pac.RLock()
+	pacScript, ttl, source := pac.pacScript, pac.ttlDuration, pac.source.url
+	pac.RUnlock()
+
+	if source != "" {
+		if err := pac.Load(source, ttl); err != nil {
+			return fmt.Errorf("failed to reload PAC: %v", err)
+		}
+		return nil
+	}
+	if err := pac.Update(pacScript, ttl); err != nil {
+		return fmt.Errorf("failed to reload PAC: %v", err)
+	}
+	return nil
 }
 
 func (pac *Pac) SetAuth(username, password string) {
+	var auth *proxy.Auth
 	if username != "" && password != "" {
-		pac.Auth = &proxy.Auth{
+		auth = &proxy.Auth{
 			User:     username,
 			Password: password,
 		}
 	}
+
+	pac.Lock()
+	pac.Auth = auth
+	pac.Unlock()
+}
+
+// SetEvalLimits bounds how long a PAC evaluation, or loading a script from now
+// on, may run and sets the route used when it fails or times out, "DIRECT" if
+// empty
+func (pac *Pac) SetEvalLimits(timeout time.Duration, defaultRoute string) {
+	if defaultRoute == "" {
+		defaultRoute = "DIRECT"
+	}
+
+	pac.Lock()
+	defer pac.Unlock()
+	pac.evalTimeout = timeout
+	pac.defaultRoute = defaultRoute
+}
+
+// SetMaxScriptSize caps the size of the PAC scripts loaded from now on, in
+// bytes
+func (pac *Pac) SetMaxScriptSize(size int64) {
+	pac.Lock()
+	defer pac.Unlock()
+	pac.maxScriptSize = size
+}
+
+func (pac *Pac) scriptLimit() int64 {
+	pac.RLock()
+	defer pac.RUnlock()
+	return pac.maxScriptSize
+}
+
+// SetCacheKeyMode changes what PAC answers are cached by, flushing the cache
+func (pac *Pac) SetCacheKeyMode(mode CacheKeyMode) {
+	pac.Lock()
+	defer pac.Unlock()
+	if mode == pac.cacheKeyMode {
+		return
+	}
+	pac.cacheKeyMode = mode
+	pac.keyMode = mode
+	if mode == CacheKeyAuto {
+		pac.keyMode = detectCacheKeyMode(pac.pacScript)
+	}
+	pac.PacCache = newPacCache(pac.stats)
+	pac.flight = &singleflight.Group{}
+}
+
+// UpstreamAuth returns the credentials for the upstream proxies, nil if none
+func (pac *Pac) UpstreamAuth() *proxy.Auth {
+	pac.RLock()
+	defer pac.RUnlock()
+	return pac.Auth
+}
+
+// cacheState is what a lookup needs, read at once since Update swaps it
+type cacheState struct {
+	cache        *lru.Cache[string, cacheEntry]
+	pool         *sync.Pool
+	flight       *singleflight.Group
+	stats        *cacheCounters
+	keyMode      CacheKeyMode
+	ttl          time.Duration
+	evalTimeout  time.Duration
+	defaultRoute string
+}
+
+func (pac *Pac) state() cacheState {
+	pac.RLock()
+	defer pac.RUnlock()
+	return cacheState{
+		cache:        pac.PacCache,
+		pool:         pac.Pool,
+		flight:       pac.flight,
+		stats:        pac.stats,
+		keyMode:      pac.keyMode,
+		ttl:          pac.ttlDuration,
+		evalTimeout:  pac.evalTimeout,
+		defaultRoute: pac.defaultRoute,
+	}
 }
 
 func (p *Pac) PacCacheToString() (string, error) {
-	keys := append([]string(nil), p.PacCache.Keys()...)
+	pacCache := p.state().cache
+	keys := append([]string(nil), pacCache.Keys()...)
 	sort.Strings(keys)
 
 	out := make(map[string]any, len(keys))
 	for _, k := range keys {
-		if v, ok := p.PacCache.Get(k); ok {
-			out[k] = v
+		if v, ok := pacCache.Peek(k); ok {
+			out[k] = v.value
 		}
 	}
 
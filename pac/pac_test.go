@@ -0,0 +1,210 @@
+package pac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpdate(t *testing.T) {
+	p, err := NewPac(`function FindProxyForURL(url, host) { return "PROXY old:3128"; }`, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := GetFromCache("http://example.com/", p); got != "PROXY old:3128" {
+		t.Fatalf("Expected the first script to answer, got %q", got)
+	}
+
+	if err := p.Update(`function FindProxyForURL(url, host) {`, time.Minute); err == nil {
+		t.Errorf("Expected a broken script to be rejected")
+	}
+	if got := GetFromCache("http://example.com/", p); got != "PROXY old:3128" {
+		t.Errorf("Expected a failed update to keep the old script, got %q", got)
+	}
+
+	if err := p.Update(`function FindProxyForURL(url, host) { return "DIRECT"; }`, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got := GetFromCache("http://example.com/", p); got != "DIRECT" {
+		t.Errorf("Expected the new script to answer and the cache to be flushed, got %q", got)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	var mu sync.Mutex
+	script := `function FindProxyForURL(url, host) { return "PROXY old:3128"; }`
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(script))
+	}))
+	t.Cleanup(server.Close)
+	update := func(newScript, newEtag string) {
+		mu.Lock()
+		script, etag = newScript, newEtag
+		mu.Unlock()
+	}
+
+	p, err := NewPacFromURL(server.URL, time.Minute, "", DefaultMaxScriptSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := p.Refresh(); err != nil || changed {
+		t.Errorf("Expected an unchanged PAC to be kept, got %v, %v", changed, err)
+	}
+
+	update(`function FindProxyForURL(url, host) {`, `"v2"`)
+	if _, err := p.Refresh(); err == nil {
+		t.Errorf("Expected a broken PAC to be rejected")
+	}
+	if got := GetFromCache("http://example.com/", p); got != "PROXY old:3128" {
+		t.Errorf("Expected the old PAC to keep serving, got %q", got)
+	}
+
+	// An empty 200 is a failure, not an unchanged PAC
+	update("", `"empty"`)
+	if changed, err := p.Refresh(); err == nil || changed {
+		t.Errorf("Expected an empty PAC to be reported, got %v, %v", changed, err)
+	}
+	if got := GetFromCache("http://example.com/", p); got != "PROXY old:3128" {
+		t.Errorf("Expected the old PAC to keep serving, got %q", got)
+	}
+
+	update(`function FindProxyForURL(url, host) { return "DIRECT"; }`, `"v3"`)
+	if changed, err := p.Refresh(); err != nil || !changed {
+		t.Fatalf("Expected the new PAC to be installed, got %v, %v", changed, err)
+	}
+	if got := GetFromCache("http://example.com/", p); got != "DIRECT" {
+		t.Errorf("Expected the new PAC to answer, got %q", got)
+	}
+
+	update(`function FindProxyForURL(url, host) { return "PROXY new:3128"; }`, `"v4"`)
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := GetFromCache("http://example.com/", p); got != "PROXY new:3128" {
+		t.Errorf("Expected Reload to download the PAC again, got %q", got)
+	}
+}
+
+func TestRefreshDoesNotUndoLoad(t *testing.T) {
+	var requests atomic.Int32
+	refreshing, release := make(chan struct{}), make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > 1 {
+			close(refreshing)
+			<-release
+			w.Write([]byte(`function FindProxyForURL(url, host) { return "PROXY refreshed:3128"; }`))
+			return
+		}
+		w.Write([]byte(`function FindProxyForURL(url, host) { return "PROXY old:3128"; }`))
+	}))
+	t.Cleanup(slow.Close)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`function FindProxyForURL(url, host) { return "PROXY loaded:3128"; }`))
+	}))
+	t.Cleanup(other.Close)
+
+	p, err := NewPacFromURL(slow.URL, time.Minute, "", DefaultMaxScriptSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		changed bool
+		err     error
+	}
+	done := make(chan result)
+	go func() {
+		changed, err := p.Refresh()
+		done <- result{changed, err}
+	}()
+	<-refreshing
+	if err := p.Load(other.URL, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	if r := <-done; r.err != nil || r.changed {
+		t.Errorf("Expected the refresh to give way to the load, got %v, %v", r.changed, r.err)
+	}
+	if got := GetFromCache("http://example.com/", p); got != "PROXY loaded:3128" {
+		t.Errorf("Expected the loaded PAC to keep serving, got %q", got)
+	}
+	if got := p.sourceURL(); got != other.URL {
+		t.Errorf("Expected the source to stay %s, got %s", other.URL, got)
+	}
+}
+
+func TestOfflineStartup(t *testing.T) {
+	pacRetryInterval = 10 * time.Millisecond
+	cacheDir := t.TempDir()
+
+	var reachable atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !reachable.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`function FindProxyForURL(url, host) { return "PROXY corp:3128"; }`))
+	}))
+	t.Cleanup(server.Close)
+
+	p, err := NewPacFromURL(server.URL, time.Minute, cacheDir, DefaultMaxScriptSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := GetFromCache("http://example.com/", p); got != "DIRECT" || !p.Offline() {
+		t.Fatalf("Expected DIRECT without a saved copy, got %q", got)
+	}
+
+	reachable.Store(true)
+	for deadline := time.Now().Add(5 * time.Second); p.Offline(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the background retry to reach the PAC")
+		}
+	}
+	if got := GetFromCache("http://example.com/", p); got != "PROXY corp:3128" {
+		t.Errorf("Expected the real PAC once reachable, got %q", got)
+	}
+
+	// The copy saved above is used on the next offline start
+	reachable.Store(false)
+	p, err = NewPacFromURL(server.URL, time.Minute, cacheDir, DefaultMaxScriptSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := GetFromCache("http://example.com/", p); got != "PROXY corp:3128" || !p.Offline() {
+		t.Errorf("Expected the saved copy to be used, got %q", got)
+	}
+}
+
+func TestOfflineRetryStops(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	p, err := NewPacFromURL(server.URL, time.Minute, "", DefaultMaxScriptSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	time.Sleep(10 * pacRetryInterval) // let a retry that was already running finish
+	before := requests.Load()
+	time.Sleep(10 * pacRetryInterval)
+	if after := requests.Load(); after != before {
+		t.Errorf("Expected Close to stop the retries, got %d more downloads", after-before)
+	}
+}
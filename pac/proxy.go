@@ -2,22 +2,71 @@ package pac
 
 import (
 	"fmt"
+	"log"
 	"net/url"
 	"strings"
 )
 
-func HandleProxy(target string, p *Pac) (*url.URL, error) {
-	rawUrl := GetFromCache(target, p)
-
-	proxyFields := strings.Fields(rawUrl)
-	switch strings.ToUpper(proxyFields[0]) {
-	case "PROXY":
-		return url.Parse("http://" + proxyFields[1])
-	case "SOCKS", "SOCKS5":
-		return url.Parse("socks5://" + proxyFields[1])
-	case "DIRECT":
-		return nil, nil // no proxy
-	default:
-		return nil, fmt.Errorf("unsupported proxy type: %s", proxyFields[0])
+// HandleProxy evaluates the PAC script for target and returns every upstream
+// it listed, in order. A nil entry means the connection should go DIRECT.
+func HandleProxy(target string, p *Pac) ([]*url.URL, error) {
+	return ParseProxyList(GetFromCache(target, p))
+}
+
+// ParseProxyList parses a FindProxyForURL answer such as
+// "PROXY a:8080; PROXY b:8080; DIRECT" into an ordered candidate list.
+func ParseProxyList(rawUrl string) ([]*url.URL, error) {
+	// An empty answer means DIRECT according to the PAC specification
+	if strings.TrimSpace(rawUrl) == "" {
+		return []*url.URL{nil}, nil
+	}
+
+	var candidates []*url.URL
+	for _, entry := range strings.Split(rawUrl, ";") {
+		proxyFields := strings.Fields(entry)
+		if len(proxyFields) == 0 {
+			continue
+		}
+
+		var scheme string
+		switch strings.ToUpper(proxyFields[0]) {
+		case "PROXY":
+			scheme = "http"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5"
+		case "SOCKS4":
+			scheme = "socks4"
+		case "DIRECT":
+			candidates = append(candidates, nil) // no proxy
+			continue
+		default:
+			log.Printf("Skipping unsupported proxy type: %s", proxyFields[0])
+			continue
+		}
+
+		if len(proxyFields) < 2 {
+			log.Printf("Skipping %s entry without an address", proxyFields[0])
+			continue
+		}
+
+		proxyURL, err := url.Parse(scheme + "://" + proxyFields[1])
+		if err != nil {
+			log.Printf("Skipping invalid proxy address %s: %v", proxyFields[1], err)
+			continue
+		}
+		candidates = append(candidates, proxyURL)
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no usable proxy in PAC result: %s", rawUrl)
+	}
+	return candidates, nil
+}
+
+// ProxyName returns a printable name for a candidate returned by HandleProxy
+func ProxyName(proxyURL *url.URL) string {
+	if proxyURL == nil {
+		return "DIRECT"
 	}
+	return proxyURL.String()
 }
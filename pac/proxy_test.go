@@ -0,0 +1,30 @@
+package pac
+
+import (
+	"testing"
+)
+
+func TestParseProxyList(t *testing.T) {
+	candidates, err := ParseProxyList("PROXY a:8080; PROXY b:8080;SOCKS c:1080; SOCKS4 d:1080; DIRECT")
+	if err != nil {
+		t.Fatalf("Expected PAC result to parse: %v", err)
+	}
+
+	expected := []string{"http://a:8080", "http://b:8080", "socks5://c:1080", "socks4://d:1080", "DIRECT"}
+	if len(candidates) != len(expected) {
+		t.Fatalf("Expected %d candidates, got %d", len(expected), len(candidates))
+	}
+	for i, proxyURL := range candidates {
+		if ProxyName(proxyURL) != expected[i] {
+			t.Errorf("Expected candidate %d to be %s, got %s", i, expected[i], ProxyName(proxyURL))
+		}
+	}
+
+	if candidates, err := ParseProxyList(""); err != nil || len(candidates) != 1 || candidates[0] != nil {
+		t.Errorf("Expected an empty answer to mean DIRECT")
+	}
+
+	if _, err := ParseProxyList("FTP a:21; PROXY"); err == nil {
+		t.Errorf("Expected an error when no entry is usable")
+	}
+}
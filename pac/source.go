@@ -0,0 +1,337 @@
+package pac
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var pacClient = &http.Client{
+	Timeout: time.Second * 300,
+}
+
+// How often a local PAC file is checked for changes
+var fileWatchInterval = 2 * time.Second
+
+// pacSource remembers where a PAC came from and the validators of the last
+// download, so refreshes can ask the server whether it changed
+type pacSource struct {
+	url          string
+	etag         string
+	lastModified string
+	wpadURL      string // PAC found by the last WPAD discovery when url is AutoDiscover
+}
+
+// pacDownload is the answer to a PAC download
+type pacDownload struct {
+	script      string
+	source      pacSource
+	notModified bool // the server answered 304 or the file didn't change, script is empty
+}
+
+func DownloadPAC(pacURL string) (string, error) {
+	download, err := downloadPAC(pacSource{url: pacURL}, DefaultMaxScriptSize)
+	if err != nil {
+		return "", err
+	}
+	return download.script, nil
+}
+
+// downloadPAC fetches the PAC at source.url, sending the validators stored in
+// source if any. Scripts over limit bytes are refused. Besides HTTP(S),
+// file:// URLs, plain paths and data: URLs are read locally.
+func downloadPAC(source pacSource, limit int64) (*pacDownload, error) {
+	if source.url == AutoDiscover {
+		return discoverPAC(source, limit)
+	}
+	if strings.HasPrefix(source.url, "data:") {
+		return readDataPAC(source)
+	}
+	if path, ok := localPath(source.url); ok {
+		return readFilePAC(source, path, limit)
+	}
+	return fetchPAC(pacClient, source, limit)
+}
+
+// fetchPAC downloads the PAC at source.url over HTTP(S)
+func fetchPAC(client *http.Client, source pacSource, limit int64) (*pacDownload, error) {
+	req, err := http.NewRequest(http.MethodGet, source.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download pac from %s: %w", source.url, err)
+	}
+	if source.etag != "" {
+		req.Header.Set("If-None-Match", source.etag)
+	}
+	if source.lastModified != "" {
+		req.Header.Set("If-Modified-Since", source.lastModified)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download pac from %s: %w", source.url, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return &pacDownload{source: source, notModified: true}, nil
+	default:
+		return nil, fmt.Errorf("failed to download pac from %s: %s", source.url, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read answer from PAC: %w", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("pac from %s is over the %d bytes limit", source.url, limit)
+	}
+	if err := checkNotEmpty(source.url, data); err != nil {
+		return nil, err
+	}
+
+	return &pacDownload{
+		script: string(data),
+		source: pacSource{
+			url:          source.url,
+			etag:         resp.Header.Get("ETag"),
+			lastModified: resp.Header.Get("Last-Modified"),
+		},
+	}, nil
+}
+
+// localPath returns the file a PAC source points to, for file:// URLs and
+// plain paths
+func localPath(pacURL string) (string, bool) {
+	u, err := url.Parse(pacURL)
+	switch {
+	case pacURL == "" || pacURL == AutoDiscover:
+		return "", false
+	case err != nil || u.Scheme == "" || len(u.Scheme) == 1: // C:\proxy.pac parses as scheme "c"
+		return pacURL, true
+	case u.Scheme == "file":
+		return u.Path, true
+	}
+	return "", false
+}
+
+// readFilePAC reads a local PAC, using its modification time as validator
+func readFilePAC(source pacSource, path string, limit int64) (*pacDownload, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pac from %s: %w", path, err)
+	}
+	if info.Size() > limit {
+		return nil, fmt.Errorf("pac %s is over the %d bytes limit", path, limit)
+	}
+	modTime := info.ModTime().UTC().Format(time.RFC3339Nano)
+	if modTime == source.lastModified {
+		return &pacDownload{source: source, notModified: true}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pac from %s: %w", path, err)
+	}
+	if err := checkNotEmpty(path, data); err != nil {
+		return nil, err
+	}
+	return &pacDownload{
+		script: string(data),
+		source: pacSource{url: source.url, lastModified: modTime},
+	}, nil
+}
+
+// readDataPAC decodes a data: URL, data:[<mediatype>][;base64],<script>
+func readDataPAC(source pacSource) (*pacDownload, error) {
+	meta, data, ok := strings.Cut(strings.TrimPrefix(source.url, "data:"), ",")
+	if !ok {
+		return nil, errors.New("invalid data URL for pac: missing ','")
+	}
+
+	var script []byte
+	var err error
+	if strings.HasSuffix(meta, ";base64") {
+		script, err = base64.StdEncoding.DecodeString(data)
+	} else {
+		var unescaped string
+		unescaped, err = url.PathUnescape(data)
+		script = []byte(unescaped)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid data URL for pac: %w", err)
+	}
+	if err := checkNotEmpty("data URL", script); err != nil {
+		return nil, err
+	}
+	return &pacDownload{script: string(script), source: pacSource{url: source.url}}, nil
+}
+
+// checkNotEmpty refuses a blank PAC, so a source that starts answering with
+// nothing is reported instead of passing for an unchanged one
+func checkNotEmpty(where string, script []byte) error {
+	if len(bytes.TrimSpace(script)) == 0 {
+		return fmt.Errorf("pac from %s is empty", where)
+	}
+	return nil
+}
+
+// NewPacFromURL downloads the PAC at pacURL and remembers it as the source
+// used by Reload and Refresh. Every successful download is saved in cacheDir.
+// If the source can't be reached the saved copy is used, or DIRECT for
+// everything when there is none, while the download is retried in the
+// background. Scripts over maxScriptSize bytes are refused.
+func NewPacFromURL(pacURL string, ttl time.Duration, cacheDir string, maxScriptSize int64) (*Pac, error) {
+	download, err := downloadPAC(pacSource{url: pacURL}, maxScriptSize)
+	if err == nil {
+		pac, err := newPac(download.script, ttl, maxScriptSize)
+		if err == nil {
+			pac.source = download.source
+			pac.cacheDir = cacheDir
+			if err := saveLastGood(cacheDir, pacURL, download.script); err != nil {
+				log.Println(err)
+			}
+			return pac, nil
+		}
+		log.Println("Downloaded PAC doesn't compile:", err)
+	} else {
+		log.Println(err)
+	}
+
+	pac, cacheErr := newPacFromLastGood(pacURL, ttl, cacheDir, maxScriptSize)
+	if cacheErr != nil {
+		log.Printf("No usable saved copy of %s (%v), using DIRECT until it can be downloaded", pacURL, cacheErr)
+		if pac, cacheErr = newPac(directOnlyPAC, ttl, maxScriptSize); cacheErr != nil {
+			return nil, cacheErr
+		}
+	}
+	pac.source = pacSource{url: pacURL}
+	pac.cacheDir = cacheDir
+	pac.offline = true
+	go pac.retryDownload(pac.source, ttl, pac.generation)
+	return pac, nil
+}
+
+func newPacFromLastGood(pacURL string, ttl time.Duration, cacheDir string, maxScriptSize int64) (*Pac, error) {
+	pacScript, err := loadLastGood(cacheDir, pacURL)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Using the saved copy of %s", pacURL)
+	return newPac(pacScript, ttl, maxScriptSize)
+}
+
+// Load downloads the PAC at pacURL and swaps it in, making pacURL the new
+// source. The current script keeps serving if the download or compilation
+// fails.
+func (pac *Pac) Load(pacURL string, ttl time.Duration) error {
+	download, err := downloadPAC(pacSource{url: pacURL}, pac.scriptLimit())
+	if err != nil {
+		return err
+	}
+	_, err = pac.install(download, ttl, nil)
+	return err
+}
+
+// Refresh asks the source whether the PAC changed and swaps in the new script
+// if it did. It reports whether the script was replaced. A script swapped in
+// by Load or Update while the download ran wins over the refreshed one.
+func (pac *Pac) Refresh() (bool, error) {
+	pac.RLock()
+	source, pacScript, ttl, generation, limit := pac.source, pac.pacScript, pac.ttlDuration, pac.generation, pac.maxScriptSize
+	pac.RUnlock()
+	if source.url == "" {
+		return false, nil
+	}
+
+	download, err := downloadPAC(source, limit)
+	if err != nil {
+		return false, err
+	}
+	// Servers without validators answer 200 every time
+	if download.notModified || download.script == pacScript {
+		return false, nil
+	}
+	return pac.install(download, ttl, &generation)
+}
+
+// install swaps in a downloaded script and saves a copy of it. With a
+// generation it only does so if the script wasn't swapped since then.
+func (pac *Pac) install(download *pacDownload, ttl time.Duration, generation *uint64) (bool, error) {
+	installed, err := pac.swap(download.script, ttl, &download.source, generation)
+	if !installed {
+		return false, err
+	}
+
+	pac.RLock()
+	cacheDir := pac.cacheDir
+	pac.RUnlock()
+	if err := saveLastGood(cacheDir, download.source.url, download.script); err != nil {
+		log.Println(err)
+	}
+	return true, nil
+}
+
+// SetRefreshInterval refreshes the PAC from its source every interval in the
+// background, replacing any previous schedule. 0 stops refreshing. Local
+// files are always watched for changes.
+func (pac *Pac) SetRefreshInterval(interval time.Duration) {
+	pac.Lock()
+	defer pac.Unlock()
+	if pac.stopRefresh != nil {
+		pac.stopRefresh()
+		pac.stopRefresh = nil
+	}
+	select {
+	case <-pac.closed:
+		return // Close stops for good
+	default:
+	}
+	if _, ok := localPath(pac.source.url); ok {
+		interval = fileWatchInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pac.stopRefresh = cancel
+	if pac.source.url == AutoDiscover {
+		go pac.watchNetwork(ctx)
+	}
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			changed, err := pac.Refresh()
+			if err != nil {
+				log.Println("Failed to refresh PAC, keeping the current one:", err)
+			} else if changed {
+				log.Println("PAC refreshed from", pac.sourceURL())
+			}
+		}
+	}()
+}
+
+func (pac *Pac) sourceURL() string {
+	pac.RLock()
+	defer pac.RUnlock()
+	return pac.source.url
+}
@@ -0,0 +1,63 @@
+package pac
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalPACSources(t *testing.T) {
+	script := `function FindProxyForURL(url, host) { return "PROXY local:3128"; }`
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := os.WriteFile(path, []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sources := []string{
+		path,
+		"file://" + filepath.ToSlash(path),
+		"data:application/x-ns-proxy-autoconfig;base64," + base64.StdEncoding.EncodeToString([]byte(script)),
+		"data:," + `function%20FindProxyForURL(url,%20host)%20%7B%20return%20%22PROXY%20local:3128%22;%20%7D`,
+	}
+	for _, source := range sources {
+		p, err := NewPacFromURL(source, time.Minute, "", DefaultMaxScriptSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := GetFromCache("http://example.com/", p); got != "PROXY local:3128" || p.Offline() {
+			t.Errorf("Expected %s to load, got %q", source, got)
+		}
+	}
+}
+
+func TestFilePACRefresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := os.WriteFile(path, []byte(`function FindProxyForURL(url, host) { return "PROXY old:3128"; }`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPacFromURL(path, time.Minute, "", DefaultMaxScriptSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := p.Refresh(); err != nil || changed {
+		t.Errorf("Expected an untouched file to be kept, got %v, %v", changed, err)
+	}
+
+	if err := os.WriteFile(path, []byte(`function FindProxyForURL(url, host) { return "DIRECT"; }`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the modification time moves even on coarse filesystems
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := p.Refresh(); err != nil || !changed {
+		t.Fatalf("Expected the edited file to be picked up, got %v, %v", changed, err)
+	}
+	if got := GetFromCache("http://example.com/", p); got != "DIRECT" {
+		t.Errorf("Expected the edited PAC to answer, got %q", got)
+	}
+}
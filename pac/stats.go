@@ -0,0 +1,69 @@
+package pac
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// CacheStats counts what happened in a Pac's cache since it was created
+type CacheStats struct {
+	Hits        uint64 // answered from the cache, stale answers included
+	Misses      uint64 // needed a PAC evaluation
+	Evictions   uint64 // entries pushed out by newer ones when the cache was full
+	Expirations uint64 // lookups that found their entry past its TTL
+	Evaluations uint64 // FindProxyForURL runs, background refreshes included
+}
+
+type cacheCounters struct {
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	evictions   atomic.Uint64
+	expirations atomic.Uint64
+	evaluations atomic.Uint64
+}
+
+// Stats returns the cache statistics of this instance
+func (pac *Pac) Stats() CacheStats {
+	return CacheStats{
+		Hits:        pac.stats.hits.Load(),
+		Misses:      pac.stats.misses.Load(),
+		Evictions:   pac.stats.evictions.Load(),
+		Expirations: pac.stats.expirations.Load(),
+		Evaluations: pac.stats.evaluations.Load(),
+	}
+}
+
+// HitRatio returns the share of lookups answered from the cache, in percent
+func (s CacheStats) HitRatio() uint64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return s.Hits * 100 / (s.Hits + s.Misses)
+}
+
+// LogStats logs the cache statistics every interval until ctx is done
+func (pac *Pac) LogStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stats := pac.Stats()
+		if stats.Hits != 0 {
+			log.Printf("Cache hits: %v, misses: %v, evictions: %v, expirations: %v | %v%% of cache hits\n",
+				stats.Hits, stats.Misses, stats.Evictions, stats.Expirations, stats.HitRatio())
+		}
+	}
+}
+
+// Close stops the background refresh, WPAD watch and download retries
+func (pac *Pac) Close() {
+	pac.closeOnce.Do(func() { close(pac.closed) })
+	pac.SetRefreshInterval(0)
+}
@@ -0,0 +1,63 @@
+package pac
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStatsPerInstance(t *testing.T) {
+	script := `function FindProxyForURL(url, host) { return "DIRECT"; }`
+	first, err := NewPac(script, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewPac(script, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(first.Close)
+	t.Cleanup(second.Close)
+
+	GetFromCache("http://a.example/", first)
+	GetFromCache("http://a.example/", first)
+	if got := first.Stats(); got.Hits != 1 || got.Misses != 1 {
+		t.Errorf("Expected 1 hit and 1 miss, got %+v", got)
+	}
+	if got := second.Stats(); got != (CacheStats{}) {
+		t.Errorf("Expected a second instance to have its own stats, got %+v", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	GetFromCache("http://a.example/", first)
+	if got := first.Stats(); got.Expirations != 1 {
+		t.Errorf("Expected an expiration, got %+v", got)
+	}
+
+	for i := 0; i <= pacCacheSize; i++ {
+		GetFromCache(fmt.Sprintf("http://%d.example/", i), second)
+	}
+	if got := second.Stats(); got.Evictions != 1 {
+		t.Errorf("Expected the oldest entry to be evicted, got %+v", got)
+	}
+}
+
+func TestLogStatsStops(t *testing.T) {
+	p, err := NewPac(`function FindProxyForURL(url, host) { return "DIRECT"; }`, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.LogStats(ctx, time.Millisecond)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected LogStats to return once its context is done")
+	}
+}
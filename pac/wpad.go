@@ -0,0 +1,192 @@
+package pac
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AutoDiscover as PAC URL finds the PAC with WPAD: DHCP option 252 first,
+// then wpad.<domain>/wpad.dat walking up the DNS search domains
+const AutoDiscover = "auto"
+
+// How often the network is checked for changes that call for a new discovery
+var networkPollInterval = 5 * time.Second
+
+// wpadDiscovery holds where WPAD looks for the PAC
+type wpadDiscovery struct {
+	domains        []string      // DNS search domains, most specific first
+	resolver       *net.Resolver // resolves the wpad.<domain> names
+	dhcpServer     string        // where DHCPINFORM is sent
+	dhcpClientPort int           // port the DHCP answer comes back to
+	httpPort       string        // port wpad.<domain> serves wpad.dat on
+	maxScriptSize  int64         // largest PAC accepted, in bytes
+}
+
+func newWPADDiscovery(maxScriptSize int64) *wpadDiscovery {
+	return &wpadDiscovery{
+		domains:        searchDomains(),
+		resolver:       net.DefaultResolver,
+		dhcpServer:     "255.255.255.255:67",
+		dhcpClientPort: 68,
+		httpPort:       "80",
+		maxScriptSize:  maxScriptSize,
+	}
+}
+
+// discoverPAC runs WPAD discovery. Refreshes ask the PAC found last time
+// first and only discover again if it is gone.
+func discoverPAC(source pacSource, limit int64) (*pacDownload, error) {
+	if source.wpadURL != "" {
+		download, err := fetchPAC(pacClient, pacSource{url: source.wpadURL, etag: source.etag, lastModified: source.lastModified}, limit)
+		if err == nil {
+			download.source.wpadURL = source.wpadURL
+			download.source.url = AutoDiscover
+			return download, nil
+		}
+		log.Println("Previously discovered PAC is gone, discovering again:", err)
+	}
+	return newWPADDiscovery(limit).discover(context.Background())
+}
+
+// discover returns the first PAC that downloads and compiles
+func (d *wpadDiscovery) discover(ctx context.Context) (*pacDownload, error) {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{Resolver: d.resolver, Timeout: 5 * time.Second}).DialContext,
+		},
+	}
+	try := func(pacURL string) (*pacDownload, error) {
+		download, err := fetchPAC(client, pacSource{url: pacURL}, d.maxScriptSize)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := newVMPool(download.script, DefaultEvalTimeout); err != nil {
+			return nil, err
+		}
+		log.Println("WPAD found PAC at", pacURL)
+		download.source.wpadURL = pacURL
+		download.source.url = AutoDiscover
+		return download, nil
+	}
+
+	if pacURL, err := d.dhcpWPAD(ctx); err != nil {
+		log.Println("WPAD over DHCP failed:", err)
+	} else if download, err := try(pacURL); err != nil {
+		log.Printf("PAC from DHCP at %s is unusable: %v", pacURL, err)
+	} else {
+		return download, nil
+	}
+
+	for _, domain := range devolve(d.domains) {
+		host := "wpad." + domain
+		if _, err := d.resolver.LookupHost(ctx, host+"."); err != nil {
+			continue
+		}
+		pacURL := "http://" + host + "/wpad.dat"
+		if d.httpPort != "80" {
+			pacURL = "http://" + net.JoinHostPort(host, d.httpPort) + "/wpad.dat"
+		}
+		download, err := try(pacURL)
+		if err == nil {
+			return download, nil
+		}
+		log.Printf("PAC at %s is unusable: %v", pacURL, err)
+	}
+	return nil, errors.New("WPAD discovery found no usable PAC")
+}
+
+// devolve lists the domains WPAD tries, dept.corp.example gives
+// dept.corp.example then corp.example. Top level domains are never tried.
+func devolve(domains []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		labels := strings.Split(strings.Trim(strings.ToLower(domain), "."), ".")
+		for i := 0; i+2 <= len(labels); i++ {
+			candidate := strings.Join(labels[i:], ".")
+			if !seen[candidate] {
+				seen[candidate] = true
+				out = append(out, candidate)
+			}
+		}
+	}
+	return out
+}
+
+// searchDomains returns the domain of the host name followed by the search
+// domains from /etc/resolv.conf
+func searchDomains() []string {
+	var domains []string
+	if hostname, err := os.Hostname(); err == nil {
+		if _, domain, ok := strings.Cut(hostname, "."); ok {
+			domains = append(domains, domain)
+		}
+	}
+
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return domains
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && (fields[0] == "search" || fields[0] == "domain") {
+			domains = append(domains, fields[1:]...)
+		}
+	}
+	return domains
+}
+
+// networkState summarizes the local addresses, it changes when the machine
+// joins another network
+func networkState() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	list := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		list = append(list, addr.String())
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// watchNetwork discovers the PAC again whenever the local addresses change
+func (pac *Pac) watchNetwork(ctx context.Context) {
+	ticker := time.NewTicker(networkPollInterval)
+	defer ticker.Stop()
+	state := networkState()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := networkState()
+		if current == state {
+			continue
+		}
+		state = current
+
+		log.Println("Network changed, running WPAD discovery again")
+		pac.RLock()
+		ttl := pac.ttlDuration
+		pac.RUnlock()
+		if err := pac.Load(AutoDiscover, ttl); err != nil {
+			log.Println("Keeping the current PAC:", fmt.Errorf("WPAD discovery failed: %w", err))
+		}
+	}
+}
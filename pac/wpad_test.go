@@ -0,0 +1,159 @@
+package pac
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startDNSServer answers A queries for the names in hosts with 127.0.0.1
+// and NXDOMAIN for anything else
+func startDNSServer(t *testing.T, hosts ...string) *net.Resolver {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) == 0 {
+				continue
+			}
+			q := query.Questions[0]
+			answer := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true, RCode: dnsmessage.RCodeNameError},
+				Questions: query.Questions,
+			}
+			for _, host := range hosts {
+				if strings.EqualFold(q.Name.String(), host+".") {
+					answer.RCode = dnsmessage.RCodeSuccess
+					if q.Type == dnsmessage.TypeA {
+						answer.Answers = []dnsmessage.Resource{{
+							Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+							Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+						}}
+					}
+				}
+			}
+			packed, err := answer.Pack()
+			if err == nil {
+				conn.WriteTo(packed, addr)
+			}
+		}
+	}()
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+// startDHCPServer answers DHCPINFORM with option 252 set to pacURL
+func startDHCPServer(t *testing.T, pacURL string) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n < 240 || buf[0] != dhcpBootRequest {
+				continue
+			}
+			reply := make([]byte, 240)
+			reply[0] = dhcpBootReply
+			copy(reply[4:8], buf[4:8])
+			copy(reply[236:240], dhcpMagicCookie)
+			reply = append(reply, dhcpOptionType, 1, 5, dhcpOptionWPAD, byte(len(pacURL)+1))
+			reply = append(reply, pacURL...)
+			reply = append(reply, 0, dhcpOptionEnd)
+			conn.WriteToUDP(reply, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func startWPADServer(t *testing.T, result string) (*httptest.Server, string) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`function FindProxyForURL(url, host) { return "` + result + `"; }`))
+	}))
+	t.Cleanup(server.Close)
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	return server, port
+}
+
+func TestDevolve(t *testing.T) {
+	got := devolve([]string{"Dept.Corp.Example.", "corp.example", "example"})
+	want := []string{"dept.corp.example", "corp.example"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestWPADDiscovery(t *testing.T) {
+	_, port := startWPADServer(t, "PROXY dns:3128")
+	d := &wpadDiscovery{
+		domains:       []string{"dept.corp.example"},
+		resolver:      startDNSServer(t, "wpad.corp.example"),
+		dhcpServer:    "127.0.0.1:1", // nobody answers DHCP
+		httpPort:      port,
+		maxScriptSize: DefaultMaxScriptSize,
+	}
+
+	download, err := d.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(download.script, "PROXY dns:3128") || !strings.HasPrefix(download.source.wpadURL, "http://wpad.corp.example:") {
+		t.Errorf("Expected the PAC from wpad.corp.example, got %+v", download.source)
+	}
+
+	// DHCP wins over DNS
+	dhcpPAC, _ := startWPADServer(t, "PROXY dhcp:3128")
+	d.dhcpServer = startDHCPServer(t, dhcpPAC.URL+"/proxy.pac")
+	download, err = d.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(download.script, "PROXY dhcp:3128") || download.source.url != AutoDiscover {
+		t.Errorf("Expected the PAC announced over DHCP, got %+v", download.source)
+	}
+}
+
+func TestParseDHCPWPAD(t *testing.T) {
+	pkt := dhcpInformPacket(42, net.IPv4(10, 0, 0, 2), nil)
+	if _, ok, _ := parseDHCPWPAD(pkt, 42); ok {
+		t.Errorf("Expected our own request not to be taken as an answer")
+	}
+
+	pkt[0] = dhcpBootReply
+	binary.BigEndian.PutUint32(pkt[4:8], 43)
+	if _, ok, _ := parseDHCPWPAD(pkt, 42); ok {
+		t.Errorf("Expected answers to other transactions to be ignored")
+	}
+}
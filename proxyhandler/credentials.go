@@ -0,0 +1,140 @@
+package proxyhandler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Credentials holds the users allowed to use GoProxy's listeners, loaded from
+// an htpasswd file with bcrypt hashes (htpasswd -B)
+type Credentials struct {
+	users    map[string][]byte   // user -> bcrypt hash
+	verified map[string][32]byte // user -> sha256 of the last password that matched
+	dummy    []byte              // checked for unknown users so they take as long as known ones
+	mu       sync.Mutex
+}
+
+// LoadCredentials reads an htpasswd file. Entries that aren't bcrypt hashes
+// are skipped.
+func LoadCredentials(path string) (*Credentials, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open htpasswd file: %w", err)
+	}
+	defer file.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		// format: user:$2y$10$...
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || !strings.HasPrefix(hash, "$2") {
+			log.Printf("Skipping htpasswd entry for %q, only bcrypt hashes are supported", user)
+			continue
+		}
+		users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read htpasswd file: %w", err)
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("no usable users in %s", path)
+	}
+
+	dummy, err := dummyHash(users)
+	if err != nil {
+		return nil, err
+	}
+	return &Credentials{
+		users:    users,
+		verified: make(map[string][32]byte),
+		dummy:    dummy,
+	}, nil
+}
+
+// dummyHash returns a hash as costly as the most costly user's, so checking
+// an unknown user doesn't reveal that it doesn't exist
+func dummyHash(users map[string][]byte) ([]byte, error) {
+	cost := 0
+	for _, hash := range users {
+		if c, err := bcrypt.Cost(hash); err == nil && c > cost {
+			cost = c
+		}
+	}
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	dummy, err := bcrypt.GenerateFromPassword([]byte("goproxy-unknown-user"), cost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare credential checks: %w", err)
+	}
+	return dummy, nil
+}
+
+// Replace swaps in the users of a freshly loaded htpasswd file
+func (c *Credentials) Replace(other *Credentials) {
+	other.mu.Lock()
+	users, dummy := other.users, other.dummy
+	other.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users, c.dummy = users, dummy
+	c.verified = make(map[string][32]byte)
+}
+
+// Valid implements socks5.CredentialStore
+func (c *Credentials) Valid(user, password, userAddr string) bool {
+	sum := sha256.Sum256([]byte(password))
+
+	c.mu.Lock()
+	hash, ok := c.users[user]
+	last, cached := c.verified[user]
+	dummy := c.dummy
+	c.mu.Unlock()
+	if !ok {
+		// Same bcrypt work as a known user, so the timing doesn't tell them apart
+		bcrypt.CompareHashAndPassword(dummy, []byte(password))
+		log.Printf("Rejected credentials for user %q from %s", user, userAddr)
+		return false
+	}
+
+	// bcrypt is slow on purpose, avoid paying for it on every request
+	if cached && subtle.ConstantTimeCompare(last[:], sum[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		log.Printf("Rejected credentials for user %q from %s", user, userAddr)
+		return false
+	}
+
+	c.mu.Lock()
+	// Don't cache a password checked against a hash a reload just replaced
+	if current, ok := c.users[user]; ok && bytes.Equal(current, hash) {
+		c.verified[user] = sum
+	}
+	c.mu.Unlock()
+	return true
+}
+
+// checkProxyAuthorization validates the Basic credentials a client sent to
+// the HTTP listener
+func (c *Credentials) checkProxyAuthorization(r *http.Request) bool {
+	auth := &http.Request{Header: http.Header{"Authorization": r.Header.Values("Proxy-Authorization")}}
+	user, password, ok := auth.BasicAuth()
+	return ok && c.Valid(user, password, r.RemoteAddr)
+}
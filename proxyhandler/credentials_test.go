@@ -0,0 +1,83 @@
+package proxyhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/proxy"
+)
+
+func writeHtpasswd(t *testing.T) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// htpasswd -B writes $2y$ hashes
+	content := "# team users\n" +
+		testUser + ":" + strings.Replace(string(hash), "$2a$", "$2y$", 1) + "\n" +
+		"legacy:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCredentials(t *testing.T) {
+	creds, err := LoadCredentials(writeHtpasswd(t))
+	if err != nil {
+		t.Fatalf("Expected htpasswd file to load: %v", err)
+	}
+
+	for i := 0; i < 2; i++ { // second round is served from the verified cache
+		if !creds.Valid(testUser, testPassword, "127.0.0.1") {
+			t.Errorf("Expected valid credentials to be accepted")
+		}
+	}
+	if creds.Valid(testUser, "wrong", "127.0.0.1") {
+		t.Errorf("Expected a wrong password to be rejected")
+	}
+	if creds.Valid("legacy", "password", "127.0.0.1") {
+		t.Errorf("Expected non bcrypt entries to be ignored")
+	}
+
+	// Unknown users go through bcrypt at the same cost as known ones
+	if cost, err := bcrypt.Cost(creds.dummy); err != nil || cost != bcrypt.MinCost {
+		t.Errorf("Expected the dummy hash to cost %d, got %d (%v)", bcrypt.MinCost, cost, err)
+	}
+	if creds.Valid("nobody", testPassword, "127.0.0.1") {
+		t.Errorf("Expected unknown users to be rejected")
+	}
+}
+
+func TestHTTPListenerRequiresCredentials(t *testing.T) {
+	creds, err := LoadCredentials(writeHtpasswd(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://goproxy/help", nil)
+	rec := httptest.NewRecorder()
+	HandleHTTPConnection(rec, req, nil, nil, creds)
+	if rec.Code != http.StatusProxyAuthRequired || rec.Header().Get("Proxy-Authenticate") == "" {
+		t.Errorf("Expected a Basic challenge without credentials, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://goproxy/help", nil)
+	req.Header.Set("Proxy-Authorization", basicAuth(&proxy.Auth{User: testUser, Password: testPassword}))
+	rec = httptest.NewRecorder()
+	HandleHTTPConnection(rec, req, nil, nil, creds)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected valid credentials to be let through, got %d", rec.Code)
+	}
+	if req.Header.Get("Proxy-Authorization") != "" {
+		t.Errorf("Expected client credentials to be stripped before forwarding")
+	}
+}
@@ -0,0 +1,247 @@
+package proxyhandler
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LucasSnatiago/GoProxy/pac"
+	"golang.org/x/net/proxy"
+)
+
+const upstreamDialTimeout = 300 * time.Second
+
+// dialCandidates connects to target through the first candidate that works,
+// in the order the PAC listed them. DIRECT is only tried when listed, so an
+// upstream refusing the tunnel is never bypassed.
+func dialCandidates(ctx context.Context, candidates []*url.URL, target string, auth *proxy.Auth) (net.Conn, error) {
+	err := fmt.Errorf("no route to %s", target)
+	for _, proxyURL := range candidates {
+		var server net.Conn
+		if server, err = dialUpstream(ctx, proxyURL, target, auth); err == nil {
+			return server, nil
+		}
+		log.Printf("Failed to open tunnel to %s via %s: %v", target, pac.ProxyName(proxyURL), err)
+	}
+	return nil, err
+}
+
+// dialUpstream opens a tunnel to target through a single candidate, nil
+// meaning DIRECT
+func dialUpstream(ctx context.Context, proxyURL *url.URL, target string, auth *proxy.Auth) (net.Conn, error) {
+	switch {
+	case proxyURL == nil:
+		d := &net.Dialer{Timeout: upstreamDialTimeout}
+		server, err := d.DialContext(ctx, "tcp", target)
+		if err != nil {
+			log.Println("DIRECT failed:", err)
+			return nil, fmt.Errorf("failed to connect to %s: %w", target, err)
+		}
+		log.Printf("DIRECT accessed %s\n", target)
+		return server, nil
+
+	case isSocks(proxyURL):
+		server, err := dialSocks(ctx, proxyURL, target, auth)
+		if err != nil {
+			log.Printf("%s failed: %v", strings.ToUpper(proxyURL.Scheme), err)
+			return nil, fmt.Errorf("failed to connect through %s: %w", proxyURL, err)
+		}
+		log.Printf("%s accessed %s via %s\n", strings.ToUpper(proxyURL.Scheme), target, proxyURL.Host)
+		return server, nil
+
+	default:
+		server, resp, err := dialHTTPConnect(ctx, proxyURL, target, auth)
+		if err != nil {
+			log.Println("Fail to connect to proxy for HTTPS:", err)
+			return nil, err
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			server.Close()
+			return nil, &upstreamStatusError{proxy: proxyURL.Host, status: resp.Status, code: resp.StatusCode}
+		}
+		return server, nil
+	}
+}
+
+// dialSocks connects to target through the SOCKS upstream described by proxyURL
+func dialSocks(ctx context.Context, proxyURL *url.URL, target string, auth *proxy.Auth) (net.Conn, error) {
+	forward := &net.Dialer{Timeout: upstreamDialTimeout}
+
+	switch proxyURL.Scheme {
+	case "socks5":
+		dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, forward)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SOCKS5 dialer: %w", err)
+		}
+		return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", target)
+	case "socks4":
+		return dialSocks4(ctx, forward, proxyURL.Host, target, auth)
+	default:
+		return nil, fmt.Errorf("unsupported SOCKS scheme: %s", proxyURL.Scheme)
+	}
+}
+
+func isSocks(proxyURL *url.URL) bool {
+	return proxyURL != nil && (proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks4")
+}
+
+// How long an idle upstream connection is kept for the next request
+const upstreamIdleTimeout = 90 * time.Second
+
+// Transports are shared per upstream and credentials, so their idle
+// connections are reused instead of piling up with every request
+var upstreamTransports sync.Map // upstreamKey -> http.RoundTripper
+
+type upstreamKey struct {
+	proxy          string
+	user, password string
+}
+
+// upstreamTransport returns the shared transport sending plain HTTP requests
+// through proxyURL, or directly when proxyURL is nil
+func upstreamTransport(proxyURL *url.URL, auth *proxy.Auth) http.RoundTripper {
+	var key upstreamKey
+	if proxyURL != nil {
+		key.proxy = proxyURL.String()
+		if auth != nil {
+			key.user, key.password = auth.User, auth.Password
+		}
+	}
+	if t, ok := upstreamTransports.Load(key); ok {
+		return t.(http.RoundTripper)
+	}
+	t, _ := upstreamTransports.LoadOrStore(key, newUpstreamTransport(proxyURL, auth))
+	return t.(http.RoundTripper)
+}
+
+// newUpstreamTransport returns a transport that sends plain HTTP requests
+// through proxyURL, or directly when proxyURL is nil
+func newUpstreamTransport(proxyURL *url.URL, auth *proxy.Auth) http.RoundTripper {
+	if isSocks(proxyURL) {
+		return &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialSocks(ctx, proxyURL, addr, auth)
+			},
+			DisableCompression: true,
+			IdleConnTimeout:    upstreamIdleTimeout,
+		}
+	}
+
+	trnprt := &http.Transport{
+		Proxy:              http.ProxyURL(proxyURL),
+		DisableCompression: true,
+		IdleConnTimeout:    upstreamIdleTimeout,
+	}
+	if proxyURL == nil || auth == nil {
+		return trnprt
+	}
+	return &proxyAuthTransport{base: trnprt, auth: auth}
+}
+
+// Largest challenge body drained to keep the connection for the answer,
+// bigger ones are answered on a new connection
+const maxChallengeBody = 64 << 10
+
+// dialHTTPConnect opens a CONNECT tunnel to target through the HTTP proxy at
+// proxyURL, answering authentication challenges along the way. It returns the
+// proxy's final answer to the CONNECT together with the connection, which is
+// positioned right after that answer.
+func dialHTTPConnect(ctx context.Context, proxyURL *url.URL, target string, auth *proxy.Auth) (net.Conn, *http.Response, error) {
+	d := &net.Dialer{Timeout: upstreamDialTimeout}
+	authenticator := newProxyAuthenticator(auth)
+
+	// The whole handshake, challenges included, has to finish by then
+	deadline := time.Now().Add(upstreamDialTimeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+
+	var conn net.Conn
+	var br *bufio.Reader
+	var stop func() bool
+	drop := func() {
+		stop()
+		conn.Close()
+		conn = nil
+	}
+	fail := func(msg string, err error) (net.Conn, *http.Response, error) {
+		drop()
+		if ctx.Err() != nil {
+			err = ctx.Err() // ctx closed the connection under us
+		}
+		return nil, nil, fmt.Errorf("%s: %w", msg, err)
+	}
+
+	authorization := ""
+	for {
+		if conn == nil {
+			var err error
+			if conn, err = d.DialContext(ctx, "tcp", proxyURL.Host); err != nil {
+				return nil, nil, fmt.Errorf("failed to connect to proxy: %w", err)
+			}
+			br = bufio.NewReader(conn)
+			conn.SetDeadline(deadline)
+			// Don't wait for an upstream that never answers once the client is gone
+			server := conn
+			stop = context.AfterFunc(ctx, func() { server.Close() })
+		}
+
+		connectReq := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: target},
+			Host:   target,
+			Header: http.Header{},
+		}
+		if authorization != "" {
+			connectReq.Header.Set("Proxy-Authorization", authorization)
+		}
+		if err := connectReq.Write(conn); err != nil {
+			return fail("failed to write CONNECT request", err)
+		}
+
+		resp, err := http.ReadResponse(br, connectReq)
+		if err != nil {
+			return fail("failed to read CONNECT response", err)
+		}
+
+		value, ok := authenticator.respond(resp, http.MethodConnect, target)
+		if !ok {
+			if !stop() {
+				return fail("CONNECT interrupted", ctx.Err())
+			}
+			conn.SetDeadline(time.Time{})
+			return &bufferedConn{Conn: conn, r: br}, resp, nil
+		}
+		authorization = value
+
+		// Keep the connection for the answer unless the proxy is closing it
+		if resp.Close {
+			drop()
+			continue
+		}
+		n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, maxChallengeBody+1))
+		resp.Body.Close()
+		if err != nil || n > maxChallengeBody {
+			drop()
+		}
+	}
+}
+
+// bufferedConn is a net.Conn whose reads first drain data that was already
+// buffered while parsing the upstream's response
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,200 @@
+package proxyhandler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"golang.org/x/net/proxy"
+)
+
+// startEchoServer returns the address of a TCP server that echoes every line
+func startEchoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startSocks4Server returns the address of a minimal SOCKS4a stand-in that
+// only accepts the user "goproxy"
+func startSocks4Server(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				header := make([]byte, 8)
+				if _, err := io.ReadFull(br, header); err != nil {
+					return
+				}
+				user, _ := br.ReadString(0)
+				host := net.IP(header[4:8]).String()
+				if header[4] == 0 && header[5] == 0 && header[6] == 0 {
+					host, _ = br.ReadString(0)
+					host = host[:len(host)-1]
+				}
+				port := int(header[2])<<8 | int(header[3])
+
+				if user != "goproxy\x00" {
+					conn.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				server, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+				if err != nil {
+					conn.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer server.Close()
+				conn.Write([]byte{0, socks4Granted, 0, 0, 0, 0, 0, 0})
+				go io.Copy(server, br)
+				io.Copy(conn, server)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func expectEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatalf("Failed to write through tunnel: %v", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("Expected echo through tunnel, got %q (%v)", line, err)
+	}
+}
+
+func TestDialSocks5(t *testing.T) {
+	echo := startEchoServer(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	server := socks5.NewServer(socks5.WithCredential(socks5.StaticCredentials{"goproxy": "secret"}))
+	go server.Serve(ln)
+
+	proxyURL := &url.URL{Scheme: "socks5", Host: ln.Addr().String()}
+	conn, err := dialSocks(context.Background(), proxyURL, echo, &proxy.Auth{User: "goproxy", Password: "secret"})
+	if err != nil {
+		t.Fatalf("Expected SOCKS5 tunnel to open: %v", err)
+	}
+	expectEcho(t, conn)
+
+	if _, err := dialSocks(context.Background(), proxyURL, echo, &proxy.Auth{User: "goproxy", Password: "wrong"}); err == nil {
+		t.Errorf("Expected SOCKS5 tunnel to fail with bad credentials")
+	}
+}
+
+func TestDialSocks4(t *testing.T) {
+	echo := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(echo)
+	proxyURL := &url.URL{Scheme: "socks4", Host: startSocks4Server(t)}
+	auth := &proxy.Auth{User: "goproxy"}
+
+	conn, err := dialSocks(context.Background(), proxyURL, echo, auth)
+	if err != nil {
+		t.Fatalf("Expected SOCKS4 tunnel to open: %v", err)
+	}
+	expectEcho(t, conn)
+
+	conn, err = dialSocks(context.Background(), proxyURL, net.JoinHostPort("localhost", port), auth)
+	if err != nil {
+		t.Fatalf("Expected SOCKS4a tunnel to open: %v", err)
+	}
+	expectEcho(t, conn)
+
+	if _, err := dialSocks(context.Background(), proxyURL, echo, nil); err == nil {
+		t.Errorf("Expected SOCKS4 tunnel to be rejected for an unknown user")
+	}
+}
+
+func TestUpstreamTransportIsShared(t *testing.T) {
+	upstream, _ := url.Parse("http://upstream.example:3128")
+	auth := &proxy.Auth{User: "user", Password: "secret"}
+
+	if upstreamTransport(upstream, auth) != upstreamTransport(upstream, auth) {
+		t.Error("Expected requests through the same upstream to share a transport")
+	}
+	if upstreamTransport(upstream, auth) == upstreamTransport(upstream, nil) {
+		t.Error("Expected other credentials to get their own transport")
+	}
+	if upstreamTransport(nil, auth) != upstreamTransport(nil, nil) {
+		t.Error("Expected direct requests to share a transport")
+	}
+}
+
+func TestDialHTTPConnectSilentUpstream(t *testing.T) {
+	// Accepts connections and never answers the CONNECT
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	silent := &url.URL{Scheme: "http", Host: ln.Addr().String()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, _, err := dialHTTPConnect(ctx, silent, "example.com:443", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the handshake to stop when the client goes away, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := dialHTTPConnect(ctx, silent, "example.com:443", nil); err == nil {
+		t.Error("Expected the handshake to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected a silent upstream to be given up on, took %v", elapsed)
+	}
+}
@@ -1,19 +1,26 @@
 package proxyhandler
 
 import (
-	"fmt"
+	"bytes"
 	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"time"
 
 	"github.com/LucasSnatiago/GoProxy/adblock"
 	"github.com/LucasSnatiago/GoProxy/pac"
 )
 
-func HandleHTTPConnection(w http.ResponseWriter, r *http.Request, pacparser *pac.Pac, adblock *adblock.AdBlocker) {
+func HandleHTTPConnection(w http.ResponseWriter, r *http.Request, pacparser *pac.Pac, adblock *adblock.AdBlocker, creds *Credentials) {
+	if creds != nil && !creds.checkProxyAuthorization(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="GoProxy"`)
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return
+	}
+	// Our own credentials must never reach the upstream or the origin
+	r.Header.Del("Proxy-Authorization")
+
 	if adblock != nil && shouldBlockAds(r, adblock) {
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("Forbidden"))
@@ -25,11 +32,6 @@ func HandleHTTPConnection(w http.ResponseWriter, r *http.Request, pacparser *pac
 		return
 	}
 
-	// Add the proxy authentication if provided
-	if pacparser.Auth != nil {
-		r.SetBasicAuth(pacparser.Auth.User, pacparser.Auth.Password)
-	}
-
 	if r.Method == http.MethodConnect {
 		handleHTTPS(w, r, pacparser)
 	} else {
@@ -42,21 +44,40 @@ func handlePlainHTTP(w http.ResponseWriter, req *http.Request, pacparser *pac.Pa
 	req.URL.Scheme = "http"
 	req.URL.Host = req.Host
 
-	trnprt := &http.Transport{
-		Proxy: func(r *http.Request) (*url.URL, error) {
-			return pac.HandleProxy(fmt.Sprintf("http://%s", r.Host), pacparser)
-		},
-		DisableCompression: true,
+	candidates, err := pac.HandleProxy(req.URL.String(), pacparser)
+	if err != nil {
+		log.Println("Failed to resolve proxy (HTTP):", err)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("Bad Gateway"))
+		return
 	}
 
-	clientHTTP := &http.Client{
-		Timeout:   300 * time.Second,
-		Transport: trnprt,
-	}
+	// The body must be sent again if the first upstream fails
+	bufferRequestBody(req)
 
-	resp, err := clientHTTP.Do(req)
-	if err != nil {
-		log.Printf("Failed to send request to %s: %v", req.URL, err)
+	var resp *http.Response
+	for i, proxyURL := range candidates {
+		if i > 0 {
+			if req.GetBody == nil {
+				break
+			}
+			if req.Body, err = req.GetBody(); err != nil {
+				break
+			}
+		}
+
+		clientHTTP := &http.Client{
+			Timeout:   300 * time.Second,
+			Transport: upstreamTransport(proxyURL, pacparser.UpstreamAuth()),
+		}
+
+		resp, err = clientHTTP.Do(req)
+		if err == nil {
+			break
+		}
+		log.Printf("Failed to send request to %s via %s: %v", req.URL, pac.ProxyName(proxyURL), err)
+	}
+	if resp == nil {
 		w.WriteHeader(http.StatusBadGateway)
 		w.Write([]byte("Bad Gateway"))
 		return
@@ -84,9 +105,37 @@ func shouldBlockAds(req *http.Request, adblocker *adblock.AdBlocker) bool {
 		host = req.Host // If no port is specified, use the whole host
 	}
 
-	if adblocker.CheckIfAppearsOnAdblockList(host) {
-		log.Printf("Blocked request to %s due to adblock rules", req.Host)
+	if list, blocked := adblocker.BlockedBy(host); blocked {
+		log.Printf("Blocked request to %s due to adblock list %s", req.Host, list)
 		return true
 	}
 	return false
 }
+
+// Request bodies up to this size are kept in memory so they can be replayed
+// when failing over to the next upstream
+const maxReplayBodySize = 10 << 20
+
+func bufferRequestBody(req *http.Request) {
+	if req.Body == nil || req.Body == http.NoBody {
+		req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxReplayBodySize+1))
+	if err != nil || len(data) > maxReplayBodySize {
+		// Too big (or broken) to replay, stream it once
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), req.Body), req.Body}
+		req.GetBody = nil
+		return
+	}
+
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+}
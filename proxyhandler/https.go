@@ -2,80 +2,71 @@ package proxyhandler
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
-	"time"
 
 	"github.com/LucasSnatiago/GoProxy/pac"
 )
 
 func handleHTTPS(w http.ResponseWriter, req *http.Request, pacparser *pac.Pac) {
-	proxyURL, err := pac.HandleProxy(fmt.Sprintf("https:%s", req.URL), pacparser)
+	candidates, err := pac.HandleProxy(fmt.Sprintf("https:%s", req.URL), pacparser)
 	if err != nil {
 		log.Println("Failed to resolve proxy (HTTPS):", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
 		return
 	}
 
-	target := req.Host
-	if proxyURL == nil {
-		DoHTTPSDirectConnection(w, req, target)
+	server, err := dialCandidates(req.Context(), candidates, req.Host, pacparser.UpstreamAuth())
+	if err != nil {
+		status := statusForTunnelError(err)
+		http.Error(w, fmt.Sprintf("%s: %v", http.StatusText(status), err), status)
 		return
 	}
+	defer server.Close()
 
-	if err := DoHTTPSProxyTunnel(w, req, proxyURL.Host, target); err != nil {
-		log.Println("Failed to connect to proxy for HTTPS:", err)
-		log.Println("Trying direct connection instead. If it works, means the proxy is not configured correctly...")
-		DoHTTPSDirectConnection(w, req, target)
-		return
-	}
+	spliceEstablished(w, server)
 }
 
-func DoHTTPSProxyTunnel(w http.ResponseWriter, r *http.Request, proxyURL string, target string) error {
-	server, err := net.DialTimeout("tcp", proxyURL, time.Second*300)
-	if err != nil {
-		log.Println("Fail to connect to proxy for HTTPS:", err)
-		return fmt.Errorf("failed to connect to proxy: %w", err)
-	}
-	defer server.Close()
+// upstreamStatusError is returned when an upstream proxy answers CONNECT with
+// anything but 2xx
+type upstreamStatusError struct {
+	proxy  string
+	status string
+	code   int
+}
 
-	connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
-	if _, err := server.Write([]byte(connectReq)); err != nil {
-		log.Println("Failed to write CONNECT to proxy:", err)
-		server.Close()
-		return fmt.Errorf("failed to write CONNECT request: %w", err)
-	}
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("proxy %s refused the tunnel: %s", e.proxy, e.status)
+}
 
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-		return fmt.Errorf("hijacking not supported")
+// statusForTunnelError picks the status the client gets when no tunnel could
+// be opened
+func statusForTunnelError(err error) int {
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.code {
+		case http.StatusForbidden, http.StatusGatewayTimeout:
+			return statusErr.code
+		default:
+			// Including 407: the client can't fix our upstream credentials
+			return http.StatusBadGateway
+		}
 	}
 
-	client, bufrw, err := hj.Hijack()
-	if err != nil {
-		log.Println("Failed to hijack connection:", err)
-		return fmt.Errorf("failed to hijack connection: %w", err)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
 	}
-	defer client.Close()
-
-	exchangeData(client, server, bufrw)
-	return nil
+	return http.StatusBadGateway
 }
 
-func DoHTTPSDirectConnection(w http.ResponseWriter, r *http.Request, target string) {
-	server, err := net.DialTimeout("tcp", target, time.Second*300)
-	if err != nil {
-		log.Println("DIRECT failed:", err)
-		return
-	}
-	log.Printf("DIRECT accessed %s\n", target)
-	defer server.Close()
-
-	w.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-
+// spliceEstablished tells the client the tunnel is ready and copies data
+// between it and server
+func spliceEstablished(w http.ResponseWriter, server net.Conn) {
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
@@ -89,6 +80,12 @@ func DoHTTPSDirectConnection(w http.ResponseWriter, r *http.Request, target stri
 	}
 	defer client.Close()
 
+	// Written on the raw connection so nothing else precedes the tunnel data
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		log.Println("Failed to confirm tunnel to client:", err)
+		return
+	}
+
 	exchangeData(client, server, bufrw)
 }
 
@@ -0,0 +1,65 @@
+package proxyhandler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCONNECTRefusedByUpstream(t *testing.T) {
+	_, echoPort, _ := net.SplitHostPort(startEchoServer(t))
+	echo := net.JoinHostPort("localhost", echoPort)
+
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "tunnel refused by policy", http.StatusForbidden)
+	}))
+	defer refusing.Close()
+	refusingAddr := strings.TrimPrefix(refusing.URL, "http://")
+
+	accepting := httptest.NewServer(&authProxy{scheme: "Basic"})
+	defer accepting.Close()
+	acceptingAddr := strings.TrimPrefix(accepting.URL, "http://")
+
+	// The refusal must trigger the next candidate
+	goproxyURL := startGoProxy(t, "PROXY "+refusingAddr+"; PROXY "+acceptingAddr, testUser, testPassword)
+	conn, status := connectThrough(t, goproxyURL.Host, echo)
+	if status != http.StatusOK {
+		t.Fatalf("Expected CONNECT to fall back to the next proxy, got %d", status)
+	}
+	expectEcho(t, conn)
+
+	// With no candidate left the client gets a proper HTTP error, and the
+	// reachable target isn't dialed directly behind the proxy's back
+	goproxyURL = startGoProxy(t, "PROXY "+refusingAddr)
+	conn, status = connectThrough(t, goproxyURL.Host, echo)
+	conn.Close()
+	if status != http.StatusForbidden {
+		t.Errorf("Expected the upstream refusal to be mapped to 403, got %d", status)
+	}
+
+	// Same for an upstream asking for credentials we don't have
+	goproxyURL = startGoProxy(t, "PROXY "+acceptingAddr)
+	conn, status = connectThrough(t, goproxyURL.Host, echo)
+	conn.Close()
+	if status != http.StatusBadGateway {
+		t.Errorf("Expected the 407 to be mapped to 502 without a direct attempt, got %d", status)
+	}
+}
+
+func TestStatusForTunnelError(t *testing.T) {
+	cases := map[int]int{
+		http.StatusProxyAuthRequired:   http.StatusBadGateway,
+		http.StatusForbidden:           http.StatusForbidden,
+		http.StatusGatewayTimeout:      http.StatusGatewayTimeout,
+		http.StatusServiceUnavailable:  http.StatusBadGateway,
+		http.StatusInternalServerError: http.StatusBadGateway,
+	}
+	for upstream, expected := range cases {
+		err := &upstreamStatusError{proxy: "upstream", status: http.StatusText(upstream), code: upstream}
+		if status := statusForTunnelError(err); status != expected {
+			t.Errorf("Expected upstream %d to be mapped to %d, got %d", upstream, expected, status)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+	"golang.org/x/net/proxy"
+)
+
+// NTLM message flags, see [MS-NLMP] 2.2.2.5
+const (
+	ntlmNegotiateUnicode          = 0x00000001
+	ntlmNegotiateOEM              = 0x00000002
+	ntlmRequestTarget             = 0x00000004
+	ntlmNegotiateNTLM             = 0x00000200
+	ntlmNegotiateAlwaysSign       = 0x00008000
+	ntlmNegotiateExtendedSecurity = 0x00080000
+	ntlmNegotiateTargetInfo       = 0x00800000
+	ntlmNegotiate128              = 0x20000000
+	ntlmNegotiate56               = 0x80000000
+
+	ntlmAvEOL       = 0x0000
+	ntlmAvTimestamp = 0x0007
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmNegotiate returns the first message of the NTLM handshake
+func ntlmNegotiate() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmNegotiateUnicode|ntlmNegotiateOEM|ntlmRequestTarget|
+		ntlmNegotiateNTLM|ntlmNegotiateAlwaysSign|ntlmNegotiateExtendedSecurity|ntlmNegotiate128|ntlmNegotiate56)
+	// Empty domain and workstation fields, offsets point at the end of the message
+	binary.LittleEndian.PutUint32(msg[20:], 32)
+	binary.LittleEndian.PutUint32(msg[28:], 32)
+	return msg
+}
+
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  []byte
+	targetInfo []byte
+}
+
+// parseNTLMChallenge decodes the second message of the handshake, sent by the
+// proxy in its Proxy-Authenticate header
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < 32 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, errors.New("not an NTLM challenge message")
+	}
+
+	c := &ntlmChallenge{
+		flags:     binary.LittleEndian.Uint32(msg[20:]),
+		challenge: msg[24:32],
+	}
+	if c.flags&ntlmNegotiateTargetInfo != 0 && len(msg) >= 48 {
+		length := int(binary.LittleEndian.Uint16(msg[40:]))
+		offset := int(binary.LittleEndian.Uint32(msg[44:]))
+		if offset+length > len(msg) {
+			return nil, errors.New("NTLM target info out of bounds")
+		}
+		c.targetInfo = msg[offset : offset+length]
+	}
+	return c, nil
+}
+
+// timestamp returns the server's MsvAvTimestamp if it sent one
+func (c *ntlmChallenge) timestamp() []byte {
+	info := c.targetInfo
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		length := int(binary.LittleEndian.Uint16(info[2:]))
+		if id == ntlmAvEOL || len(info) < 4+length {
+			break
+		}
+		if id == ntlmAvTimestamp && length == 8 {
+			return info[4:12]
+		}
+		info = info[4+length:]
+	}
+	return nil
+}
+
+// splitNTLMUser accepts DOMAIN\user and user@domain forms
+func splitNTLMUser(user string) (string, string) {
+	if domain, name, ok := strings.Cut(user, `\`); ok {
+		return name, domain
+	}
+	if name, domain, ok := strings.Cut(user, "@"); ok {
+		return name, domain
+	}
+	return user, ""
+}
+
+func toUnicode(s string) []byte {
+	encoded := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(encoded))
+	for i, r := range encoded {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+	return b
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// ntowfv2 derives the NTLMv2 response key, see [MS-NLMP] 3.3.2
+func ntowfv2(user, password, domain string) []byte {
+	h := md4.New()
+	h.Write(toUnicode(password))
+	return hmacMD5(h.Sum(nil), toUnicode(strings.ToUpper(user)+domain))
+}
+
+// ntlmAuthenticate answers the proxy's challenge with an NTLMv2 response
+func ntlmAuthenticate(auth *proxy.Auth, c *ntlmChallenge) ([]byte, error) {
+	user, domain := splitNTLMUser(auth.User)
+	key := ntowfv2(user, auth.Password, domain)
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+
+	timestamp := c.timestamp()
+	if timestamp == nil {
+		// Windows FILETIME: 100ns intervals since January 1, 1601
+		timestamp = binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()/100+116444736000000000))
+	}
+
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, c.targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	ntProof := hmacMD5(key, c.challenge, temp)
+	ntResponse := append(ntProof, temp...)
+	lmResponse := append(hmacMD5(key, c.challenge, clientChallenge), clientChallenge...)
+
+	flags := ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSecurity | ntlmNegotiateTargetInfo
+	encode := func(s string) []byte { return []byte(strings.ToUpper(s)) }
+	if c.flags&ntlmNegotiateUnicode != 0 {
+		flags |= ntlmNegotiateUnicode
+		encode = toUnicode
+	} else {
+		flags |= ntlmNegotiateOEM
+	}
+
+	// Fixed header followed by LM, NT, domain, user, workstation and session key
+	fields := [][]byte{lmResponse, ntResponse, encode(domain), encode(user), encode(""), nil}
+	msg := make([]byte, 64)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	offset := len(msg)
+	for i, field := range fields {
+		binary.LittleEndian.PutUint16(msg[12+8*i:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(msg[14+8*i:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(msg[16+8*i:], uint32(offset))
+		offset += len(field)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], uint32(flags))
+	for _, field := range fields {
+		msg = append(msg, field...)
+	}
+	return msg, nil
+}
+
+// ntlm answers one step of the NTLM handshake. A challenge without a token
+// starts the handshake, one carrying the server challenge finishes it.
+func (a *proxyAuthenticator) ntlm(c challenge) (string, error) {
+	if c.token == "" {
+		if a.ntlmStarted {
+			return "", errors.New("proxy restarted the NTLM handshake, credentials were rejected")
+		}
+		a.ntlmStarted = true
+		return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiate()), nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(c.token)
+	if err != nil {
+		return "", fmt.Errorf("invalid NTLM challenge: %w", err)
+	}
+	serverChallenge, err := parseNTLMChallenge(raw)
+	if err != nil {
+		return "", err
+	}
+	msg, err := ntlmAuthenticate(a.auth, serverChallenge)
+	if err != nil {
+		return "", err
+	}
+	return "NTLM " + base64.StdEncoding.EncodeToString(msg), nil
+}
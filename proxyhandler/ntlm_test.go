@@ -0,0 +1,203 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// ntlmProxy is a stand-in upstream proxy that only accepts NTLMv2 and
+// remembers each challenge by client connection, like a real NTLM proxy
+type ntlmProxy struct {
+	mu         sync.Mutex
+	challenges map[string][]byte // remote address -> server challenge
+}
+
+var ntlmTargetInfo = []byte{
+	2, 0, 8, 0, 'C', 0, 'O', 0, 'R', 0, 'P', 0, // MsvAvNbDomainName
+	7, 0, 8, 0, 1, 2, 3, 4, 5, 6, 7, 8, // MsvAvTimestamp
+	0, 0, 0, 0, // MsvAvEOL
+}
+
+func (p *ntlmProxy) challenge(remote string) []byte {
+	// A fresh challenge per connection, answers sent elsewhere don't verify
+	serverChallenge := make([]byte, 8)
+	rand.Read(serverChallenge)
+	p.mu.Lock()
+	p.challenges[remote] = serverChallenge
+	p.mu.Unlock()
+
+	msg := make([]byte, 48)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[20:], ntlmNegotiateUnicode|ntlmNegotiateNTLM|ntlmNegotiateTargetInfo)
+	copy(msg[24:], serverChallenge)
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(ntlmTargetInfo)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(ntlmTargetInfo)))
+	binary.LittleEndian.PutUint32(msg[44:], 48)
+	return append(msg, ntlmTargetInfo...)
+}
+
+// verify checks an authenticate message against the challenge sent on the
+// same connection
+func (p *ntlmProxy) verify(remote string, msg []byte) bool {
+	p.mu.Lock()
+	serverChallenge, ok := p.challenges[remote]
+	delete(p.challenges, remote)
+	p.mu.Unlock()
+	if !ok || len(msg) < 64 || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+		return false
+	}
+
+	field := func(i int) []byte {
+		length := int(binary.LittleEndian.Uint16(msg[12+8*i:]))
+		offset := int(binary.LittleEndian.Uint32(msg[16+8*i:]))
+		return msg[offset : offset+length]
+	}
+	ntResponse, domain, user := field(1), field(2), field(3)
+	if !bytes.Equal(domain, toUnicode("CORP")) || !bytes.Equal(user, toUnicode(testUser)) {
+		return false
+	}
+
+	key := ntowfv2(testUser, testPassword, "CORP")
+	temp := ntResponse[16:]
+	if !bytes.Contains(temp, ntlmTargetInfo) || !bytes.Equal(temp[8:16], ntlmTargetInfo[16:24]) {
+		return false
+	}
+	return bytes.Equal(ntResponse[:16], hmacMD5(key, serverChallenge, temp))
+}
+
+func (p *ntlmProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "NTLM ")
+	msg, _ := base64.StdEncoding.DecodeString(token)
+
+	authorized := false
+	switch {
+	case len(msg) >= 12 && binary.LittleEndian.Uint32(msg[8:]) == 1:
+		w.Header().Set("Proxy-Authenticate", "NTLM "+base64.StdEncoding.EncodeToString(p.challenge(r.RemoteAddr)))
+	case len(msg) >= 12 && binary.LittleEndian.Uint32(msg[8:]) == 3:
+		authorized = p.verify(r.RemoteAddr, msg)
+		if !authorized {
+			w.Header().Set("Proxy-Authenticate", "NTLM")
+		}
+	default:
+		w.Header().Set("Proxy-Authenticate", "NTLM")
+	}
+	if !authorized {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		server, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer server.Close()
+		w.WriteHeader(http.StatusOK)
+		client, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		exchangeData(client, server, bufrw)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	fmt.Fprintf(w, "%s %s %s", r.Method, r.URL, body)
+}
+
+func TestNTOWFv2(t *testing.T) {
+	// [MS-NLMP] 4.2.4.1.1
+	if key := hex.EncodeToString(ntowfv2("User", "Password", "Domain")); key != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Errorf("Unexpected NTOWFv2 key %s", key)
+	}
+
+	if user, domain := splitNTLMUser(`CORP\goproxy`); user != "goproxy" || domain != "CORP" {
+		t.Errorf("Expected DOMAIN\\user to be split, got %s and %s", user, domain)
+	}
+}
+
+func TestUpstreamProxyNTLM(t *testing.T) {
+	_, echoPort, _ := net.SplitHostPort(startEchoServer(t))
+	echo := net.JoinHostPort("localhost", echoPort)
+
+	upstreamSrv := httptest.NewServer(&ntlmProxy{challenges: make(map[string][]byte)})
+	defer upstreamSrv.Close()
+	upstreamAddr := strings.TrimPrefix(upstreamSrv.URL, "http://")
+
+	goproxyURL := startGoProxy(t, "PROXY "+upstreamAddr, `CORP\`+testUser, testPassword)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(goproxyURL)}}
+
+	resp, err := client.Post("http://origin.test/upload", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("Plain HTTP request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "POST http://origin.test/upload payload" {
+		t.Errorf("Expected the upstream to answer after the NTLM handshake, got %d %q", resp.StatusCode, body)
+	}
+
+	conn, status := connectThrough(t, goproxyURL.Host, echo)
+	if status != http.StatusOK {
+		t.Fatalf("Expected CONNECT to succeed after the NTLM handshake, got %d", status)
+	}
+	expectEcho(t, conn)
+
+	upstreamURL := &url.URL{Scheme: "http", Host: upstreamAddr}
+	conn, resp, err = dialHTTPConnect(t.Context(), upstreamURL, echo, &proxy.Auth{User: `CORP\` + testUser, Password: "wrong"})
+	if err != nil {
+		t.Fatalf("Expected the proxy answer to be returned, got %v", err)
+	}
+	conn.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("Expected a wrong password to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestUpstreamProxyNTLMConcurrent(t *testing.T) {
+	upstreamSrv := httptest.NewServer(&ntlmProxy{challenges: make(map[string][]byte)})
+	defer upstreamSrv.Close()
+	upstreamAddr := strings.TrimPrefix(upstreamSrv.URL, "http://")
+
+	goproxyURL := startGoProxy(t, "PROXY "+upstreamAddr, `CORP\`+testUser, testPassword)
+
+	// Each handshake must stay on its own upstream connection while the
+	// others run on the shared transport
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(goproxyURL)}}
+			resp, err := client.Post(fmt.Sprintf("http://origin.test/%d", i), "text/plain", strings.NewReader("payload"))
+			if err != nil {
+				t.Errorf("Request %d failed: %v", i, err)
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != fmt.Sprintf("POST http://origin.test/%d payload", i) {
+				t.Errorf("Request %d: expected the upstream to answer after the NTLM handshake, got %d %q", i, resp.StatusCode, body)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,270 @@
+package proxyhandler
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// Stop answering challenges after this many attempts, the credentials are
+// most likely wrong
+const maxProxyAuthAttempts = 3
+
+// proxyAuthenticator answers the Proxy-Authenticate challenges an upstream
+// proxy sends for a single request
+type proxyAuthenticator struct {
+	auth        *proxy.Auth
+	attempts    int
+	nc          int  // Digest nonce count
+	ntlmStarted bool // NTLM negotiate message already sent
+}
+
+func newProxyAuthenticator(auth *proxy.Auth) *proxyAuthenticator {
+	return &proxyAuthenticator{auth: auth}
+}
+
+// respond returns the Proxy-Authorization value that answers the 407 response
+// resp for a request with the given method and uri. It returns false when the
+// challenge can't be answered.
+func (a *proxyAuthenticator) respond(resp *http.Response, method, uri string) (string, bool) {
+	if a == nil || a.auth == nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		return "", false
+	}
+	if a.attempts >= maxProxyAuthAttempts {
+		log.Println("Upstream proxy keeps rejecting our credentials, giving up")
+		return "", false
+	}
+	a.attempts++
+
+	challenges := parseChallenges(resp.Header.Values("Proxy-Authenticate"))
+	if c, ok := challenges["ntlm"]; ok {
+		value, err := a.ntlm(c)
+		if err != nil {
+			log.Println("Failed to answer NTLM challenge:", err)
+			return "", false
+		}
+		return value, true
+	}
+	if c, ok := challenges["digest"]; ok {
+		value, err := a.digest(c, method, uri)
+		if err != nil {
+			log.Println("Failed to answer Digest challenge:", err)
+			return "", false
+		}
+		return value, true
+	}
+	if _, ok := challenges["basic"]; ok {
+		return basicAuth(a.auth), true
+	}
+
+	log.Printf("No supported scheme in Proxy-Authenticate: %v", resp.Header.Values("Proxy-Authenticate"))
+	return "", false
+}
+
+func basicAuth(auth *proxy.Auth) string {
+	r := &http.Request{Header: http.Header{}}
+	r.SetBasicAuth(auth.User, auth.Password)
+	return r.Header.Get("Authorization")
+}
+
+// digest answers an RFC 7616 challenge
+func (a *proxyAuthenticator) digest(c challenge, method, uri string) (string, error) {
+	algorithm := c.params["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported Digest algorithm: %s", algorithm)
+	}
+	h := func(s string) string {
+		hs := newHash()
+		io.WriteString(hs, s)
+		return hex.EncodeToString(hs.Sum(nil))
+	}
+
+	cnonceBytes := make([]byte, 16)
+	if _, err := rand.Read(cnonceBytes); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(cnonceBytes)
+
+	realm, nonce := c.params["realm"], c.params["nonce"]
+	ha1 := h(a.auth.User + ":" + realm + ":" + a.auth.Password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	qop := ""
+	for _, q := range strings.Split(c.params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+
+	var response string
+	a.nc++
+	nc := fmt.Sprintf("%08x", a.nc)
+	if qop != "" {
+		response = h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + nonce + ":" + ha2)
+	}
+
+	value := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, response="%s"`,
+		a.auth.User, realm, nonce, uri, algorithm, response)
+	if qop != "" {
+		value += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, qop, nc, cnonce)
+	}
+	if opaque, ok := c.params["opaque"]; ok {
+		value += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return value, nil
+}
+
+type challenge struct {
+	scheme string
+	token  string            // token68 payload such as the NTLM challenge
+	params map[string]string // auth-params such as realm and nonce
+}
+
+// parseChallenges parses Proxy-Authenticate header values, keyed by the
+// lowercase scheme name
+func parseChallenges(headers []string) map[string]challenge {
+	challenges := make(map[string]challenge)
+	for _, header := range headers {
+		scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+		if scheme == "" {
+			continue
+		}
+		c := challenge{scheme: scheme, params: make(map[string]string)}
+
+		rest = strings.TrimSpace(rest)
+		if rest != "" && !strings.ContainsAny(strings.TrimRight(rest, "="), "=, ") {
+			c.token = rest
+		} else {
+			for rest != "" {
+				var key, value string
+				key, rest, _ = strings.Cut(rest, "=")
+				key = strings.ToLower(strings.TrimSpace(strings.TrimLeft(key, ", ")))
+				rest = strings.TrimSpace(rest)
+				if strings.HasPrefix(rest, `"`) {
+					value, rest = unquote(rest[1:])
+				} else {
+					value, rest, _ = strings.Cut(rest, ",")
+				}
+				c.params[key] = strings.TrimSpace(value)
+			}
+		}
+
+		challenges[strings.ToLower(scheme)] = c
+	}
+	return challenges
+}
+
+// unquote reads a quoted-string whose opening quote was already consumed and
+// returns its value and whatever follows the closing quote
+func unquote(s string) (string, string) {
+	var value strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				value.WriteByte(s[i])
+			}
+		case '"':
+			return value.String(), strings.TrimLeft(s[i+1:], " ,")
+		default:
+			value.WriteByte(s[i])
+		}
+	}
+	return value.String(), ""
+}
+
+// proxyAuthTransport retries plain HTTP requests that an upstream proxy
+// answered with 407 using the configured credentials
+type proxyAuthTransport struct {
+	base *http.Transport
+	auth *proxy.Auth
+}
+
+func (t *proxyAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticator := newProxyAuthenticator(t.auth)
+	// NTLM authenticates a connection, so its messages can't go through the
+	// shared pool where they could land on different connections
+	var handshake *http.Transport
+	for resp.StatusCode == http.StatusProxyAuthRequired && req.GetBody != nil {
+		value, ok := authenticator.respond(resp, req.Method, req.URL.String())
+		if !ok {
+			break
+		}
+
+		body, err := req.GetBody()
+		if err != nil {
+			break
+		}
+
+		// Drain the challenge so the connection can be reused for the answer
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		req = req.Clone(req.Context())
+		req.Body = body
+		req.Header.Set("Proxy-Authorization", value)
+
+		transport := t.base
+		if authenticator.ntlmStarted {
+			if handshake == nil {
+				handshake = t.base.Clone()
+				handshake.MaxConnsPerHost = 1
+			}
+			transport = handshake
+		}
+		if resp, err = transport.RoundTrip(req); err != nil {
+			if handshake != nil {
+				handshake.CloseIdleConnections()
+			}
+			return nil, err
+		}
+	}
+
+	if handshake != nil {
+		resp.Body = &handshakeBody{ReadCloser: resp.Body, transport: handshake}
+	}
+	return resp, nil
+}
+
+// handshakeBody closes the connection of an NTLM handshake once the final
+// response has been read
+type handshakeBody struct {
+	io.ReadCloser
+	transport *http.Transport
+}
+
+func (b *handshakeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.transport.CloseIdleConnections()
+	return err
+}
@@ -0,0 +1,186 @@
+package proxyhandler
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/LucasSnatiago/GoProxy/pac"
+)
+
+const (
+	testUser     = "goproxy"
+	testPassword = "s3cret"
+	testRealm    = "upstream"
+	testNonce    = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+)
+
+// authProxy is a stand-in upstream proxy that demands credentials using scheme
+type authProxy struct {
+	scheme string
+	leaked atomic.Bool // an Authorization header reached the proxy
+}
+
+func md5hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *authProxy) authorized(r *http.Request) bool {
+	value := r.Header.Get("Proxy-Authorization")
+	switch p.scheme {
+	case "Basic":
+		req := &http.Request{Header: http.Header{"Authorization": {value}}}
+		user, password, ok := req.BasicAuth()
+		return ok && user == testUser && password == testPassword
+	case "Digest":
+		c, ok := parseChallenges([]string{value})["digest"]
+		if !ok || c.params["username"] != testUser || c.params["nonce"] != testNonce {
+			return false
+		}
+		ha1 := md5hex(testUser + ":" + testRealm + ":" + testPassword)
+		ha2 := md5hex(r.Method + ":" + c.params["uri"])
+		expected := md5hex(ha1 + ":" + testNonce + ":" + c.params["nc"] + ":" + c.params["cnonce"] + ":auth:" + ha2)
+		return c.params["response"] == expected
+	}
+	return false
+}
+
+func (p *authProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "" {
+		p.leaked.Store(true)
+	}
+
+	if !p.authorized(r) {
+		if p.scheme == "Digest" {
+			w.Header().Set("Proxy-Authenticate", fmt.Sprintf(`Digest realm="%s", qop="auth", nonce="%s", opaque="5ccc069c"`, testRealm, testNonce))
+		} else {
+			w.Header().Set("Proxy-Authenticate", fmt.Sprintf(`Basic realm="%s"`, testRealm))
+		}
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		server, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer server.Close()
+		w.WriteHeader(http.StatusOK)
+		client, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		exchangeData(client, server, bufrw)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	fmt.Fprintf(w, "%s %s %s", r.Method, r.URL, body)
+}
+
+// startGoProxy serves HandleHTTPConnection with a PAC that always answers
+// pacResult and returns the listener URL
+func startGoProxy(t *testing.T, pacResult string, auth ...string) *url.URL {
+	t.Helper()
+	pacparser, err := pac.NewPac(fmt.Sprintf(`function FindProxyForURL(url, host) { return "%s"; }`, pacResult), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auth) == 2 {
+		pacparser.SetAuth(auth[0], auth[1])
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleHTTPConnection(w, r, pacparser, nil, nil)
+	}))
+	t.Cleanup(srv.Close)
+
+	goproxyURL, _ := url.Parse(srv.URL)
+	return goproxyURL
+}
+
+// connectThrough asks the proxy at proxyAddr for a tunnel to target and
+// returns the connection along with the status the proxy answered
+func connectThrough(t *testing.T, proxyAddr, target string) (net.Conn, int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("Failed to read CONNECT response: %v", err)
+	}
+	return &bufferedConn{Conn: conn, r: br}, resp.StatusCode
+}
+
+func TestUpstreamProxyAuthentication(t *testing.T) {
+	_, echoPort, _ := net.SplitHostPort(startEchoServer(t))
+	echo := net.JoinHostPort("localhost", echoPort)
+
+	for _, scheme := range []string{"Basic", "Digest"} {
+		t.Run(scheme, func(t *testing.T) {
+			upstream := &authProxy{scheme: scheme}
+			upstreamSrv := httptest.NewServer(upstream)
+			defer upstreamSrv.Close()
+			upstreamAddr := strings.TrimPrefix(upstreamSrv.URL, "http://")
+
+			goproxyURL := startGoProxy(t, "PROXY "+upstreamAddr, testUser, testPassword)
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(goproxyURL)}}
+
+			resp, err := client.Post("http://origin.test/upload", "text/plain", strings.NewReader("payload"))
+			if err != nil {
+				t.Fatalf("Plain HTTP request failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != "POST http://origin.test/upload payload" {
+				t.Errorf("Expected the upstream to answer after authentication, got %d %q", resp.StatusCode, body)
+			}
+
+			conn, status := connectThrough(t, goproxyURL.Host, echo)
+			if status != http.StatusOK {
+				t.Fatalf("Expected CONNECT to succeed after authentication, got %d", status)
+			}
+			expectEcho(t, conn)
+
+			if upstream.leaked.Load() {
+				t.Errorf("Expected credentials to never be sent in the Authorization header")
+			}
+		})
+	}
+}
+
+func TestUpstreamProxyAuthenticationWithoutCredentials(t *testing.T) {
+	upstreamSrv := httptest.NewServer(&authProxy{scheme: "Basic"})
+	defer upstreamSrv.Close()
+
+	goproxyURL := startGoProxy(t, "PROXY "+strings.TrimPrefix(upstreamSrv.URL, "http://"))
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(goproxyURL)}}
+
+	resp, err := client.Get("http://origin.test/")
+	if err != nil {
+		t.Fatalf("Plain HTTP request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("Expected the challenge to be passed on without credentials, got %d", resp.StatusCode)
+	}
+}
@@ -1,15 +1,18 @@
 package proxyhandler
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/LucasSnatiago/GoProxy/adblock"
 	"github.com/LucasSnatiago/GoProxy/pac"
 )
 
-func handleLocalSettings(w http.ResponseWriter, r *http.Request, pacparser *pac.Pac, adblock *adblock.AdBlocker) {
+func handleLocalSettings(w http.ResponseWriter, r *http.Request, pacparser *pac.Pac, adblocker *adblock.AdBlocker) {
 	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
 	switch path[len(path)-1] {
 	case "settings":
@@ -27,16 +30,121 @@ func handleLocalSettings(w http.ResponseWriter, r *http.Request, pacparser *pac.
 			http.Error(w, fmt.Sprintf("Failed to get PAC cache: %v", err), http.StatusInternalServerError)
 			return
 		}
-		fmt.Fprintf(w, "Cache hits: %v\tCache misses: %v\n\nCached entries:\n%s", pac.CacheHits(), pac.CacheMisses(), cache_entries)
+		stats := pacparser.Stats()
+		fmt.Fprintf(w, "Cache hits: %v\tCache misses: %v\tEvictions: %v\tExpirations: %v\tEvaluations: %v\n\nCached entries:\n%s",
+			stats.Hits, stats.Misses, stats.Evictions, stats.Expirations, stats.Evaluations, cache_entries)
+	case "explain":
+		target := r.URL.Query().Get("url")
+		if target == "" {
+			http.Error(w, "Usage: /explain?url=https://example.com/", http.StatusBadRequest)
+			return
+		}
+		explanation, err := pac.Explain(target, pacparser)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to explain %s: %v", target, err), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(explanation)
+			return
+		}
+		fmt.Fprint(w, explanation)
+	case "category":
+		// POST /adblock/category?name=social&enabled=false
+		if !changeAllowed(w, r) || !adblockEnabled(w, adblocker) {
+			return
+		}
+		name := r.FormValue("name")
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if name == "" || err != nil {
+			http.Error(w, "Usage: POST /adblock/category?name=<category>&enabled=<true|false>", http.StatusBadRequest)
+			return
+		}
+		changed, err := adblocker.SetCategoryEnabled(name, enabled)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "Category %s enabled=%v, %d lists changed. Now blocking %d entries.\n", name, enabled, changed, adblocker.Len())
+	case "allowlist", "blocklist":
+		// POST /adblock/allowlist?add=dashboard.corp.example or ?remove=..., lists without either
+		list := adblock.LocalList(path[len(path)-1])
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		add, remove := r.Form.Has("add"), r.Form.Has("remove")
+		if (add || remove) && (!changeAllowed(w, r) || !adblockEnabled(w, adblocker)) {
+			return
+		}
+		var err error
+		switch {
+		case add:
+			err = adblocker.AddLocal(list, r.Form.Get("add"))
+		case remove:
+			err = adblocker.RemoveLocal(list, r.Form.Get("remove"))
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to update the %s: %v", list, err), http.StatusBadRequest)
+			return
+		}
+		patterns, _ := adblocker.LocalPatterns(list)
+		fmt.Fprintf(w, "Local %s, %d patterns:\n", list, len(patterns))
+		for _, pattern := range patterns {
+			fmt.Fprintln(w, pattern)
+		}
 	case "adblock":
-		if adblock != nil {
-			fmt.Fprintf(w, "AdBlock is enabled:\n%s", adblock.ToString())
+		// Enabled even without downloaded lists, the local ones still apply
+		if adblocker.Enabled() {
+			fmt.Fprintf(w, "AdBlock is enabled:\n%s", adblocker.ToString())
 		} else {
 			fmt.Fprintln(w, "AdBlock is disabled.")
 		}
 	case "help":
-		fmt.Fprintln(w, "Available commands:\n/settings - Show current settings\n/reload - Reload the PAC script\n/cache - Show PAC cache statistics\n/adblock - Show AdBlock status and entries\n/help - Show this help message")
+		fmt.Fprintln(w, "Available commands:\n/settings - Show current settings\n/reload - Reload the PAC script\n/cache - Show PAC cache statistics\n/explain?url=<url> - Show how the PAC routes a URL (add &format=json for JSON)\n/adblock - Show AdBlock lists and entries\nPOST /adblock/category?name=<category>&enabled=<true|false> - Turn a category of lists on or off until the next reload\nPOST /adblock/allowlist?add=<pattern> - Never block a domain (remove=<pattern> to undo, GET to list)\nPOST /adblock/blocklist?add=<pattern> - Always block a domain (remove=<pattern> to undo, GET to list)\n/help - Show this help message")
 	default:
 		http.Error(w, "Unknown local command", http.StatusNotFound)
 	}
 }
+
+// changeAllowed rejects settings changes that aren't a POST, which any page
+// could trigger with an <img> tag, or that come from another site's page
+func changeAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Changes need a POST request", http.StatusMethodNotAllowed)
+		return false
+	}
+	if crossSite(r) {
+		http.Error(w, "Changes from other sites are not allowed", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// adblockEnabled refuses adblock changes while blocking is off, they would
+// otherwise take effect unnoticed once it is turned on
+func adblockEnabled(w http.ResponseWriter, adblocker *adblock.AdBlocker) bool {
+	if !adblocker.Enabled() {
+		http.Error(w, "AdBlock is disabled, enable it with -a or adblock.enabled", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// crossSite reports whether a browser sent r on behalf of a page that isn't
+// served by GoProxy. Tools like curl send neither header.
+func crossSite(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || !strings.EqualFold(u.Host, r.Host)
+}
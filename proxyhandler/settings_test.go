@@ -0,0 +1,81 @@
+package proxyhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LucasSnatiago/GoProxy/adblock"
+	"github.com/LucasSnatiago/GoProxy/pac"
+)
+
+func TestSettingsChangesNeedSameSitePOST(t *testing.T) {
+	pacparser, err := pac.NewPac(`function FindProxyForURL(url, host) { return "DIRECT"; }`, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pacparser.Close)
+	adblocker := adblock.NewDisabledAdblock()
+
+	send := func(method, target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handleLocalSettings(rec, req, pacparser, adblocker)
+		return rec
+	}
+
+	tests := []struct {
+		method string
+		header http.Header
+		want   int
+	}{
+		{http.MethodGet, nil, http.StatusMethodNotAllowed},
+		{http.MethodPost, http.Header{"Origin": {"https://evil.example"}}, http.StatusForbidden},
+		{http.MethodPost, http.Header{"Sec-Fetch-Site": {"cross-site"}}, http.StatusForbidden},
+		{http.MethodPost, http.Header{"Origin": {"null"}}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if rec := send(tt.method, "http://goproxy/adblock/blocklist?add=tracker.example", tt.header); rec.Code != tt.want {
+			t.Errorf("%s with %v: expected %d, got %d", tt.method, tt.header, tt.want, rec.Code)
+		}
+	}
+	if adblocker.CheckIfAppearsOnAdblockList("tracker.example") {
+		t.Fatal("Expected rejected requests not to change the blocklist")
+	}
+	if rec := send(http.MethodGet, "http://goproxy/adblock/category?name=ads&enabled=false", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected categories to need a POST, got %d", rec.Code)
+	}
+
+	// Without adblock nothing is blocked and the local lists can't be changed
+	sameOrigin := http.Header{"Origin": {"http://goproxy"}}
+	if rec := send(http.MethodPost, "http://goproxy/adblock/blocklist?add=tracker.example", sameOrigin); rec.Code != http.StatusConflict {
+		t.Errorf("Expected changes to be refused while adblock is disabled, got %d", rec.Code)
+	}
+	if rec := send(http.MethodGet, "http://goproxy/adblock", nil); !strings.HasPrefix(rec.Body.String(), "AdBlock is disabled") {
+		t.Errorf("Expected adblock to be reported disabled, got %q", rec.Body)
+	}
+
+	adblocker.SetEnabled(true)
+	if rec := send(http.MethodPost, "http://goproxy/adblock/blocklist?add=tracker.example", sameOrigin); rec.Code != http.StatusOK {
+		t.Fatalf("Expected a same-origin POST to be accepted, got %d: %s", rec.Code, rec.Body)
+	}
+	if !adblocker.CheckIfAppearsOnAdblockList("tracker.example") {
+		t.Error("Expected the POST to add the pattern")
+	}
+	if rec := send(http.MethodGet, "http://goproxy/adblock/blocklist", nil); !strings.Contains(rec.Body.String(), "tracker.example") {
+		t.Errorf("Expected GET to list the blocklist, got %q", rec.Body)
+	}
+	if rec := send(http.MethodGet, "http://goproxy/adblock", nil); !strings.HasPrefix(rec.Body.String(), "AdBlock is enabled") {
+		t.Errorf("Expected the local blocklist alone to count as enabled, got %q", rec.Body)
+	}
+
+	adblocker.SetEnabled(false)
+	if adblocker.CheckIfAppearsOnAdblockList("tracker.example") {
+		t.Error("Expected the local blocklist not to apply while adblock is disabled")
+	}
+}
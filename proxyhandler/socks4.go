@@ -0,0 +1,83 @@
+package proxyhandler
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	socks4Version = 0x04
+	socks4Connect = 0x01
+	socks4Granted = 0x5a
+)
+
+// dialSocks4 opens a connection to target through a SOCKS4 server. Host names
+// are sent to the server unresolved using the SOCKS4a extension.
+func dialSocks4(ctx context.Context, forward *net.Dialer, proxyAddr, target string, auth *proxy.Auth) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOCKS4 target %s: %w", target, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOCKS4 port %s: %w", portStr, err)
+	}
+
+	// VN, CD, DSTPORT, DSTIP, USERID, NULL
+	req := []byte{socks4Version, socks4Connect}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+
+	ip := net.ParseIP(host).To4()
+	if ip == nil && net.ParseIP(host) != nil {
+		return nil, fmt.Errorf("SOCKS4 does not support IPv6 target %s", host)
+	}
+	if ip != nil {
+		req = append(req, ip...)
+	} else {
+		req = append(req, 0, 0, 0, 1) // SOCKS4a: let the server resolve the name
+	}
+
+	if auth != nil {
+		req = append(req, auth.User...)
+	}
+	req = append(req, 0)
+	if ip == nil {
+		req = append(req, host...)
+		req = append(req, 0)
+	}
+
+	conn, err := forward.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SOCKS4 proxy: %w", err)
+	}
+
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to write SOCKS4 request: %w", err)
+	}
+
+	// VN, CD, DSTPORT, DSTIP
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read SOCKS4 reply: %w", err)
+	}
+	if reply[1] != socks4Granted {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS4 proxy rejected %s with code %#x", target, reply[1])
+	}
+
+	return conn, nil
+}
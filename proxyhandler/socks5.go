@@ -1,63 +1,44 @@
 package proxyhandler
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"log"
 	"net"
-	"net/http"
-	"time"
-)
-
-type Credentials struct {
-	username string
-	password string
-}
 
-// Get network package from socks and transform it in a http proxy package
-func HttpConnectDialer(proxyHTTPAddr string, dialTimeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
-	d := &net.Dialer{
-		Timeout: dialTimeout,
-	}
+	"github.com/LucasSnatiago/GoProxy/adblock"
+	"github.com/LucasSnatiago/GoProxy/pac"
+)
 
+// SocksDialer opens SOCKS5 connections in-process, picking the upstream with
+// the PAC and applying the same adblock and failover rules as the HTTP listener
+func SocksDialer(pacparser *pac.Pac, adblocker *adblock.AdBlocker) func(ctx context.Context, network, addr string) (net.Conn, error) {
 	return func(ctx context.Context, network, addr string) (net.Conn, error) {
-		conn, err := d.DialContext(ctx, network, proxyHTTPAddr)
+		host, _, err := net.SplitHostPort(addr)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("invalid SOCKS5 destination %s: %w", addr, err)
 		}
 
-		if dl, ok := ctx.Deadline(); ok {
-			conn.SetDeadline(dl)
+		if adblocker != nil {
+			if list, blocked := adblocker.BlockedBy(host); blocked {
+				log.Printf("Blocked SOCKS5 connection to %s due to adblock list %s", addr, list)
+				return nil, fmt.Errorf("%s is blocked by adblock rules", host)
+			}
 		}
 
-		fmt.Fprintf(conn,
-			"CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Connection: Keep-Alive\r\n\r\n",
-			addr, addr,
-		)
-
-		br := bufio.NewReader(conn)
-		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		candidates, err := pac.HandleProxy(fmt.Sprintf("https://%s", addr), pacparser)
 		if err != nil {
-			conn.Close()
-			return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			conn.Close()
-			return nil, fmt.Errorf("proxy rejected CONNECT: %s", resp.Status)
+			return nil, fmt.Errorf("failed to resolve proxy (SOCKS5): %w", err)
 		}
 
-		conn.SetDeadline(time.Time{})
-		log.Printf("HTTP CONNECT tunnel established to %s via %s", addr, proxyHTTPAddr)
-		return conn, nil
+		return dialCandidates(ctx, candidates, addr, pacparser.UpstreamAuth())
 	}
 }
 
-func NewCredentials(username, password string) *Credentials {
-	return &Credentials{
-		username: username,
-		password: password,
-	}
+// SocksResolver keeps SOCKS5 host names unresolved so the PAC and the
+// upstream proxy see the name the client asked for
+type SocksResolver struct{}
+
+func (SocksResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
 }
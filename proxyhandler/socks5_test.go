@@ -0,0 +1,58 @@
+package proxyhandler
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/LucasSnatiago/GoProxy/adblock"
+	"github.com/LucasSnatiago/GoProxy/pac"
+	"github.com/things-go/go-socks5"
+	"golang.org/x/net/proxy"
+)
+
+func TestSocksDialer(t *testing.T) {
+	_, echoPort, _ := net.SplitHostPort(startEchoServer(t))
+
+	// Unresolved names must reach the PAC, anything else is sent nowhere
+	pacparser, err := pac.NewPac(`function FindProxyForURL(url, host) {
+		return host == "localhost" ? "PROXY 127.0.0.1:1; DIRECT" : "PROXY 127.0.0.1:1";
+	}`, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, _, err := adblock.ParseList([]byte("ads.localhost\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adblocker := adblock.NewAdblock([]adblock.List{{Name: "test", Enabled: true, Rules: rules}}, "", nil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	server := socks5.NewServer(
+		socks5.WithResolver(SocksResolver{}),
+		socks5.WithDial(SocksDialer(pacparser, adblocker)),
+	)
+	go server.Serve(ln)
+
+	client, err := proxy.SOCKS5("tcp", ln.Addr().String(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := client.Dial("tcp", net.JoinHostPort("localhost", echoPort))
+	if err != nil {
+		t.Fatalf("Expected SOCKS5 connection to fall back to DIRECT: %v", err)
+	}
+	expectEcho(t, conn)
+
+	if _, err := client.Dial("tcp", net.JoinHostPort("127.0.0.1", echoPort)); err == nil {
+		t.Errorf("Expected no DIRECT attempt when the PAC doesn't list it")
+	}
+	if _, err := client.Dial("tcp", net.JoinHostPort("ads.localhost", echoPort)); err == nil {
+		t.Errorf("Expected adblocked host to be refused")
+	}
+}
@@ -0,0 +1,353 @@
+package proxyhandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/LucasSnatiago/GoProxy/adblock"
+	"github.com/LucasSnatiago/GoProxy/pac"
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+	"golang.org/x/net/proxy"
+)
+
+// Drop idle UDP routes after this long, most UDP exchanges are short lived
+const udpIdleTimeout = 2 * time.Minute
+
+// udpRoute carries datagrams for one destination of a UDP association
+type udpRoute interface {
+	// send forwards a client datagram, header included
+	send(datagram []byte, pk *statute.Datagram) error
+	// receive returns the next answer as a datagram ready for the client
+	receive(buf []byte) ([]byte, error)
+	Close() error
+}
+
+// SocksAssociateHandler serves UDP ASSOCIATE. Each destination is routed with
+// the PAC: DIRECT answers are relayed straight, SOCKS5 upstreams get their
+// own UDP association. HTTP and SOCKS4 upstreams can't carry UDP and are
+// skipped.
+func SocksAssociateHandler(pacparser *pac.Pac, adblocker *adblock.AdBlocker) func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	return func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+		tcpAddr, ok := request.LocalAddr.(*net.TCPAddr)
+		if !ok {
+			socks5.SendReply(writer, statute.RepServerFailure, nil)
+			return fmt.Errorf("local address is not TCP: %T", request.LocalAddr)
+		}
+		clientAddr, ok := request.RemoteAddr.(*net.TCPAddr)
+		if !ok {
+			socks5.SendReply(writer, statute.RepServerFailure, nil)
+			return fmt.Errorf("client address is not TCP: %T", request.RemoteAddr)
+		}
+
+		bindLn, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpAddr.IP})
+		if err != nil {
+			socks5.SendReply(writer, statute.RepServerFailure, nil)
+			return fmt.Errorf("listen udp failed: %w", err)
+		}
+		defer bindLn.Close()
+
+		if err := socks5.SendReply(writer, statute.RepSuccess, bindLn.LocalAddr()); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		log.Printf("UDP association for %s relaying on %s", request.RemoteAddr, bindLn.LocalAddr())
+
+		relay := &udpRelay{
+			bindLn:    bindLn,
+			clientIP:  clientAddr.IP,
+			pacparser: pacparser,
+			adblocker: adblocker,
+			routes:    make(map[string]udpRoute),
+		}
+		go relay.serve()
+		defer relay.close()
+
+		// The association lives as long as the TCP control connection
+		_, err = io.Copy(io.Discard, request.Reader)
+		return err
+	}
+}
+
+type udpRelay struct {
+	bindLn     *net.UDPConn
+	clientIP   net.IP
+	clientAddr *net.UDPAddr // first source seen from clientIP
+	pacparser  *pac.Pac
+	adblocker  *adblock.AdBlocker
+
+	mu     sync.Mutex
+	routes map[string]udpRoute // destination -> route
+}
+
+func (r *udpRelay) serve() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, srcAddr, err := r.bindLn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("UDP association read failed:", err)
+			}
+			return
+		}
+
+		// Only the client that opened the association may use it
+		if !srcAddr.IP.Equal(r.clientIP) {
+			continue
+		}
+		if r.clientAddr == nil {
+			r.clientAddr = srcAddr
+		} else if r.clientAddr.Port != srcAddr.Port {
+			continue
+		}
+
+		pk, err := statute.ParseDatagram(buf[:n])
+		if err != nil || pk.Frag != 0 {
+			continue // fragmentation is optional in RFC 1928 and we don't support it
+		}
+
+		route, err := r.route(&pk)
+		if err != nil {
+			log.Printf("Dropping UDP datagram to %s: %v", pk.DstAddr.String(), err)
+			continue
+		}
+		if err := route.send(buf[:n], &pk); err != nil {
+			log.Printf("Failed to relay UDP datagram to %s: %v", pk.DstAddr.String(), err)
+		}
+	}
+}
+
+// route returns the route for the datagram's destination, opening it through
+// the first PAC candidate that can carry UDP
+func (r *udpRelay) route(pk *statute.Datagram) (udpRoute, error) {
+	dest := pk.DstAddr.String()
+
+	r.mu.Lock()
+	route, ok := r.routes[dest]
+	r.mu.Unlock()
+	if ok {
+		return route, nil
+	}
+
+	host, _, _ := net.SplitHostPort(dest)
+	if r.adblocker != nil && r.adblocker.CheckIfAppearsOnAdblockList(host) {
+		return nil, fmt.Errorf("%s is blocked by adblock rules", host)
+	}
+
+	candidates, err := pac.HandleProxy(fmt.Sprintf("https://%s", dest), r.pacparser)
+	if err != nil {
+		return nil, err
+	}
+
+	err = errors.New("no PAC candidate can carry UDP")
+	for _, proxyURL := range candidates {
+		switch {
+		case proxyURL == nil:
+			route, err = dialUDPDirect(dest, pk.Header())
+		case proxyURL.Scheme == "socks5":
+			route, err = dialUDPSocks5(proxyURL, r.pacparser.UpstreamAuth())
+		default:
+			continue
+		}
+		if err == nil {
+			log.Printf("UDP %s accessed via %s", dest, pac.ProxyName(proxyURL))
+			break
+		}
+		log.Printf("Failed to open UDP route to %s via %s: %v", dest, pac.ProxyName(proxyURL), err)
+	}
+	if route == nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.routes[dest] = route
+	r.mu.Unlock()
+	go r.answer(dest, route)
+	return route, nil
+}
+
+// answer sends everything the route receives back to the client
+func (r *udpRelay) answer(dest string, route udpRoute) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.routes, dest)
+		r.mu.Unlock()
+		route.Close()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		datagram, err := route.receive(buf)
+		if err != nil {
+			return
+		}
+		if _, err := r.bindLn.WriteToUDP(datagram, r.clientAddr); err != nil {
+			log.Printf("Failed to write UDP answer to %s: %v", r.clientAddr, err)
+			return
+		}
+	}
+}
+
+func (r *udpRelay) close() {
+	r.bindLn.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, route := range r.routes {
+		route.Close()
+	}
+}
+
+// udpDirectRoute sends datagrams straight to their destination
+type udpDirectRoute struct {
+	*net.UDPConn
+	header []byte // SOCKS5 header prepended to every answer
+}
+
+func dialUDPDirect(dest string, header []byte) (udpRoute, error) {
+	addr, err := net.ResolveUDPAddr("udp", dest)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpDirectRoute{UDPConn: conn, header: header}, nil
+}
+
+func (d *udpDirectRoute) send(datagram []byte, pk *statute.Datagram) error {
+	d.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+	_, err := d.Write(pk.Data)
+	return err
+}
+
+func (d *udpDirectRoute) receive(buf []byte) ([]byte, error) {
+	n, err := d.Read(buf[len(d.header):])
+	if err != nil {
+		return nil, err
+	}
+	copy(buf, d.header)
+	return buf[:len(d.header)+n], nil
+}
+
+// udpSocks5Route sends datagrams through an upstream SOCKS5 association. Both
+// directions already carry the SOCKS5 header, so datagrams pass unchanged.
+type udpSocks5Route struct {
+	*net.UDPConn
+	control net.Conn // the association ends when this connection closes
+}
+
+func dialUDPSocks5(proxyURL *url.URL, auth *proxy.Auth) (udpRoute, error) {
+	control, err := net.DialTimeout("tcp", proxyURL.Host, upstreamDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SOCKS5 proxy: %w", err)
+	}
+	control.SetDeadline(time.Now().Add(upstreamDialTimeout))
+
+	relayAddr, err := socks5Associate(control, auth)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	control.SetDeadline(time.Time{})
+
+	// Servers may answer with an unspecified address meaning "my own address"
+	if relayAddr.IP.IsUnspecified() {
+		relayAddr.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+	conn, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	route := &udpSocks5Route{UDPConn: conn, control: control}
+	go func() {
+		// Tear down the route as soon as the upstream drops the association
+		io.Copy(io.Discard, control)
+		conn.Close()
+	}()
+	return route, nil
+}
+
+// socks5Associate performs the method negotiation, optional username/password
+// authentication and UDP ASSOCIATE request on control, returning the relay
+// address the server picked
+func socks5Associate(control net.Conn, auth *proxy.Auth) (*net.UDPAddr, error) {
+	methods := []byte{statute.MethodNoAuth}
+	if auth != nil {
+		methods = append(methods, statute.MethodUserPassAuth)
+	}
+	if _, err := control.Write(statute.NewMethodRequest(statute.VersionSocks5, methods).Bytes()); err != nil {
+		return nil, fmt.Errorf("failed to write SOCKS5 greeting: %w", err)
+	}
+	method, err := statute.ParseMethodReply(control)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SOCKS5 method: %w", err)
+	}
+
+	switch method.Method {
+	case statute.MethodNoAuth:
+	case statute.MethodUserPassAuth:
+		if auth == nil {
+			return nil, errors.New("SOCKS5 proxy requires credentials")
+		}
+		req := statute.NewUserPassRequest(statute.UserPassAuthVersion, []byte(auth.User), []byte(auth.Password))
+		if _, err := control.Write(req.Bytes()); err != nil {
+			return nil, fmt.Errorf("failed to write SOCKS5 credentials: %w", err)
+		}
+		reply, err := statute.ParseUserPassReply(control)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SOCKS5 authentication reply: %w", err)
+		}
+		if reply.Status != statute.AuthSuccess {
+			return nil, errors.New("SOCKS5 proxy rejected our credentials")
+		}
+	default:
+		return nil, fmt.Errorf("SOCKS5 proxy picked unsupported method %#x", method.Method)
+	}
+
+	// We don't know the address we'll send from yet, so announce 0.0.0.0:0
+	req := statute.Request{
+		Version: statute.VersionSocks5,
+		Command: statute.CommandAssociate,
+		DstAddr: statute.AddrSpec{AddrType: statute.ATYPIPv4, IP: net.IPv4zero},
+	}
+	if _, err := control.Write(req.Bytes()); err != nil {
+		return nil, fmt.Errorf("failed to write UDP ASSOCIATE: %w", err)
+	}
+	reply, err := statute.ParseReply(control)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read UDP ASSOCIATE reply: %w", err)
+	}
+	if reply.Response != statute.RepSuccess {
+		return nil, fmt.Errorf("SOCKS5 proxy refused UDP ASSOCIATE with code %d", reply.Response)
+	}
+
+	return &net.UDPAddr{IP: reply.BndAddr.IP, Port: reply.BndAddr.Port}, nil
+}
+
+func (s *udpSocks5Route) send(datagram []byte, pk *statute.Datagram) error {
+	s.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+	_, err := s.Write(datagram)
+	return err
+}
+
+func (s *udpSocks5Route) receive(buf []byte) ([]byte, error) {
+	n, err := s.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (s *udpSocks5Route) Close() error {
+	s.control.Close()
+	return s.UDPConn.Close()
+}
@@ -0,0 +1,116 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/LucasSnatiago/GoProxy/pac"
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// startUDPEchoServer returns the port of a UDP server answering every
+// datagram with its own payload, on every local address
+func startUDPEchoServer(t *testing.T) int {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// startSocks5Server serves GoProxy's SOCKS5 handlers with a PAC that always
+// answers pacResult
+func startSocks5Server(t *testing.T, pacResult string) string {
+	t.Helper()
+	pacparser, err := pac.NewPac(fmt.Sprintf(`function FindProxyForURL(url, host) { return "%s"; }`, pacResult), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	server := socks5.NewServer(
+		socks5.WithResolver(SocksResolver{}),
+		socks5.WithDial(SocksDialer(pacparser, nil)),
+		socks5.WithAssociateHandle(SocksAssociateHandler(pacparser, nil)),
+	)
+	go server.Serve(ln)
+	return ln.Addr().String()
+}
+
+func expectUDPEcho(t *testing.T, socksAddr string, echoPort int) {
+	t.Helper()
+	control, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+
+	relayAddr, err := socks5Associate(control, nil)
+	if err != nil {
+		t.Fatalf("Expected UDP ASSOCIATE to succeed: %v", err)
+	}
+	conn, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	pk, err := statute.NewDatagram(net.JoinHostPort("localhost", strconv.Itoa(echoPort)), []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(pk.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected a UDP answer: %v", err)
+	}
+	answer, err := statute.ParseDatagram(buf[:n])
+	if err != nil || !bytes.Equal(answer.Data, []byte("ping")) {
+		t.Errorf("Expected the echo to come back with a SOCKS5 header, got %q (%v)", buf[:n], err)
+	}
+}
+
+func TestSocksUDPAssociateDirect(t *testing.T) {
+	echoPort := startUDPEchoServer(t)
+	expectUDPEcho(t, startSocks5Server(t, "PROXY 127.0.0.1:1; DIRECT"), echoPort)
+}
+
+func TestSocksUDPAssociateThroughUpstream(t *testing.T) {
+	echoPort := startUDPEchoServer(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go socks5.NewServer().Serve(ln)
+
+	expectUDPEcho(t, startSocks5Server(t, "SOCKS5 "+ln.Addr().String()), echoPort)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/LucasSnatiago/GoProxy/adblock"
+	"github.com/LucasSnatiago/GoProxy/config"
+	"github.com/LucasSnatiago/GoProxy/pac"
+	"github.com/LucasSnatiago/GoProxy/proxyhandler"
+)
+
+// reload re-reads the configuration and swaps the PAC, adblock list and
+// client credentials in place, so open tunnels keep running. Each part keeps
+// its previous state if the new one fails to load. It returns the
+// configuration now in use.
+func reload(old *config.Config, configFile string, applyFlags func(*config.Config), pacparser *pac.Pac, adblocker *adblock.AdBlocker, creds *proxyhandler.Credentials) *config.Config {
+	cfg, err := buildConfig(configFile, applyFlags)
+	if err != nil {
+		fmt.Println("Keeping the current configuration:", err)
+		return old
+	}
+
+	if err := setupLogging(cfg); err != nil {
+		fmt.Println("Keeping the current log output:", err)
+	}
+
+	// Listeners are bound once, changing them needs a restart
+	if cfg.Listen != old.Listen || cfg.HTTPPort != old.HTTPPort || cfg.SocksPort != old.SocksPort {
+		fmt.Println("Listener changes only take effect after a restart")
+	}
+
+	pacparser.SetMaxScriptSize(cfg.PAC.MaxScriptSize)
+	pacparser.SetEvalLimits(cfg.PAC.EvalTimeout, cfg.PAC.DefaultRoute)
+	if cacheKeyMode, err := pac.ParseCacheKeyMode(cfg.PAC.CacheKey); err != nil {
+		fmt.Println("Keeping the current PAC cache key mode:", err)
+	} else {
+		pacparser.SetCacheKeyMode(cacheKeyMode)
+	}
+	pacparser.SetCacheDir(cfg.PAC.CacheDir)
+	if err := pacparser.Load(cfg.PAC.URL, cfg.PAC.CacheTTL); err != nil {
+		fmt.Println("Keeping the current PAC:", err)
+	} else {
+		log.Println("PAC reloaded from", cfg.PAC.URL)
+	}
+	pacparser.SetRefreshInterval(cfg.PAC.Refresh)
+	pacparser.SetAuth(cfg.Auth.UpstreamUser, cfg.Auth.UpstreamPassword)
+
+	switch lists := adblockLists(cfg); {
+	case !cfg.Adblock.Enabled:
+		adblocker.Replace(adblock.NewDisabledAdblock())
+		adblocker.LoadLocalLists("", "")
+	case len(lists) == 0:
+		adblocker.Replace(adblock.NewDisabledAdblock())
+	default:
+		// Keep the previous lists if none of the new ones could be loaded,
+		// disabled lists count since turning every list off is a valid config
+		if list := adblock.NewAdblock(lists, cfg.Adblock.CacheDir, pacparser); list.Loaded() > 0 {
+			adblocker.Replace(list)
+			log.Printf("Adblock reloaded with %d entries", list.Len())
+		} else {
+			fmt.Println("Keeping the current adblock lists, none of the new ones could be loaded")
+		}
+	}
+	adblocker.SetEnabled(cfg.Adblock.Enabled)
+	if cfg.Adblock.Enabled {
+		if err := adblocker.LoadLocalLists(cfg.Adblock.Allowlist, cfg.Adblock.Blocklist); err != nil {
+			fmt.Println("Keeping the current local adblock lists:", err)
+		}
+		adblocker.SetRefreshInterval(cfg.Adblock.Refresh)
+	} else {
+		adblocker.SetRefreshInterval(0)
+	}
+
+	// The SOCKS5 listener picks its authentication method at startup
+	switch {
+	case (creds == nil) != (cfg.Auth.Htpasswd == ""):
+		fmt.Println("Turning client authentication on or off only takes effect after a restart")
+	case creds != nil:
+		if newCreds, err := proxyhandler.LoadCredentials(cfg.Auth.Htpasswd); err != nil {
+			fmt.Println("Keeping the current client credentials:", err)
+		} else {
+			creds.Replace(newCreds)
+		}
+	}
+
+	fmt.Println("Configuration reloaded")
+	return cfg
+}